@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"../go"
+)
+
+// Measures the write syscalls (from /proc/self/io, so Linux only) and the
+// rate of a flood of tiny sends over TCP loopback, with and without write
+// coalescing (see SetWriteCoalesce). The peer just discards the data.
+
+func tcp_pair() (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conn, <-accepted
+}
+
+// write_syscalls returns the number of write syscalls made by the process.
+func write_syscalls() int {
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "syscw: "); ok {
+			n, _ := strconv.Atoi(value)
+			return n
+		}
+	}
+	return 0
+}
+
+func flood(window time.Duration, count int) (int, time.Duration) {
+	a, b := tcp_pair()
+	tx := multiplex.NewMultiplex(a)
+	defer tx.Close()
+	defer b.Close()
+
+	tx.Enable(1, 0)
+	tx.SetWriteCoalesce(window)
+	go io.Copy(io.Discard, b)
+
+	data := []byte("0123456789abcdef")
+	writes := write_syscalls()
+	start := time.Now()
+
+	for i := 0; i < count; i++ {
+		if _, err := tx.Send(1, data); err != nil {
+			log.Fatal("send ", err)
+		}
+	}
+	if err := tx.Flush(); err != nil {
+		log.Fatal("flush ", err)
+	}
+
+	return write_syscalls() - writes, time.Since(start)
+}
+
+func main() {
+	count := flag.Int("n", 200000, "frames")
+	flag.Parse()
+
+	log.SetOutput(io.Discard)
+
+	for _, window := range []time.Duration{0, 100 * time.Microsecond, time.Millisecond} {
+		writes, elapsed := flood(window, *count)
+		fmt.Printf("coalesce %-6v: %7.4f writes/frame, %8.0f frames/s\n",
+			window, float64(writes)/float64(*count), float64(*count)/elapsed.Seconds())
+	}
+}
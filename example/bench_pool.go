@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"../go"
+)
+
+// Measures the allocations per received frame, with and without a frame
+// buffer pool (see SetFrameBufferPool), receiving 1KB frames over a
+// net.Pipe. The sender allocations are counted too, the same in both cases.
+
+const (
+	FRAME = 1024
+)
+
+func receive(pool *sync.Pool, count int) (float64, float64, time.Duration) {
+	a, b := net.Pipe()
+	tx, rx := multiplex.NewMultiplex(a), multiplex.NewMultiplex(b)
+	defer tx.Close()
+	defer rx.Close()
+
+	rx.Enable(1, 0)
+	rx.SetFrameBufferPool(pool)
+
+	data := make([]byte, FRAME)
+	go func() {
+		for i := 0; i < count; i++ {
+			tx.Send(1, data)
+		}
+	}()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	for i := 0; i < count; i++ {
+		if _, err := rx.Select(time.Second); err != nil {
+			log.Fatal("select ", err)
+		}
+		rx.Clear(1)
+	}
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	return float64(after.Mallocs-before.Mallocs) / float64(count),
+		float64(after.TotalAlloc-before.TotalAlloc) / float64(count), elapsed
+}
+
+func main() {
+	count := flag.Int("n", 200000, "frames")
+	flag.Parse()
+
+	log.SetOutput(io.Discard)
+
+	pool := &sync.Pool{New: func() interface{} {
+		buffer := make([]byte, FRAME)
+		return &buffer
+	}}
+
+	for _, bench := range []struct {
+		name string
+		pool *sync.Pool
+	}{
+		{"no pool", nil},
+		{"pool", pool},
+	} {
+		allocs, bytes, elapsed := receive(bench.pool, *count)
+		fmt.Printf("%-7s: %5.2f allocs/frame, %7.1f bytes/frame, %6.1f ns/frame\n",
+			bench.name, allocs, bytes, float64(elapsed.Nanoseconds())/float64(*count))
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"../go"
+)
+
+// Measures the rate of small frames received over TCP loopback, with and
+// without a read buffer (see WithReadBuffer). The sender coalesces its
+// writes, so that it's not the bottleneck.
+
+func tcp_pair() (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conn, <-accepted
+}
+
+func receive(options []multiplex.Option, count int) time.Duration {
+	a, b := tcp_pair()
+	tx, rx := multiplex.NewMultiplex(a), multiplex.NewMultiplex(b, options...)
+	defer tx.Close()
+	defer rx.Close()
+
+	tx.Enable(1, 0)
+	rx.Enable(1, 0)
+	tx.SetWriteCoalesce(time.Millisecond)
+
+	data := []byte("0123456789abcdef")
+	go func() {
+		for i := 0; i < count; i++ {
+			tx.Send(1, data)
+		}
+		tx.Flush()
+	}()
+
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		if _, err := rx.Select(time.Second); err != nil {
+			log.Fatal("select ", err)
+		}
+		rx.Clear(1)
+	}
+
+	return time.Since(start)
+}
+
+func main() {
+	count := flag.Int("n", 1000000, "frames")
+	flag.Parse()
+
+	log.SetOutput(io.Discard)
+
+	for _, bench := range []struct {
+		name    string
+		options []multiplex.Option
+	}{
+		{"no read buffer", nil},
+		{"4KB buffer", []multiplex.Option{multiplex.WithReadBuffer(4096)}},
+		{"64KB buffer", []multiplex.Option{multiplex.WithReadBuffer(65536)}},
+	} {
+		elapsed := receive(bench.options, *count)
+		fmt.Printf("%-14s: %9.0f frames/s\n", bench.name, float64(*count)/elapsed.Seconds())
+	}
+}
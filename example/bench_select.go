@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"../go"
+)
+
+// Measures Select with one enabled channel (a single stream over the whole
+// connection) and with several, buffering the frames locally so that only
+// the multiplexer is measured, and the throughput of a Stream over a
+// net.Pipe.
+
+func select_loop(channels uint, count int) time.Duration {
+	a, _ := net.Pipe()
+	m := multiplex.NewMultiplex(a)
+	defer m.Close()
+
+	for ch := uint(0); ch < channels; ch++ {
+		m.Enable(ch, 0)
+	}
+
+	data := []byte("0123456789abcdef")
+	start := time.Now()
+
+	for i := 0; i < count; i++ {
+		ch := uint(i) % channels
+		m.Write(ch, data)
+		if selected, err := m.Select(0); err != nil || selected != ch {
+			log.Fatal("select ", selected, " ", err)
+		}
+		m.Clear(ch)
+	}
+
+	return time.Since(start)
+}
+
+func stream_loop(channels uint, count int) time.Duration {
+	a, b := net.Pipe()
+	tx := multiplex.NewMultiplex(a)
+	rx := multiplex.NewMultiplex(b)
+	defer tx.Close()
+	defer rx.Close()
+
+	for ch := uint(0); ch < channels; ch++ {
+		rx.Enable(ch, 0)
+	}
+
+	data := make([]byte, 1024)
+	go func() {
+		for i := 0; i < count; i++ {
+			tx.Send(0, data)
+		}
+	}()
+
+	stream := multiplex.NewStream(rx, 0)
+	buffer := make([]byte, len(data))
+	start := time.Now()
+
+	for i := 0; i < count; i++ {
+		if _, err := io.ReadFull(stream, buffer); err != nil {
+			log.Fatal("read ", err)
+		}
+	}
+
+	return time.Since(start)
+}
+
+func main() {
+	count := flag.Int("n", 1000000, "iterations")
+	flag.Parse()
+
+	log.SetOutput(io.Discard)
+
+	for _, channels := range []uint{1, 16, multiplex.MAX_CHANNELS} {
+		elapsed := select_loop(channels, *count)
+		fmt.Printf("select  %3d channels: %6.1f ns/op\n", channels, float64(elapsed.Nanoseconds())/float64(*count))
+	}
+
+	for _, channels := range []uint{1, 16} {
+		elapsed := stream_loop(channels, *count/10)
+		fmt.Printf("stream  %3d channels: %6.1f MB/s\n", channels, float64(*count/10)*1024/elapsed.Seconds()/1e6)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"../go"
+)
+
+// Measures SendFile against a loop reading the file and sending each chunk,
+// over TCP loopback (so SendFile can use the zero-copy path). The peer just
+// discards the data.
+
+const (
+	CHUNK = 64 * 1024
+)
+
+func tcp_pair() (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conn, <-accepted
+}
+
+func send_loop(m *multiplex.Multiplex, f *os.File) (int64, error) {
+	buffer := make([]byte, CHUNK)
+	total := int64(0)
+
+	for {
+		n, err := f.Read(buffer)
+		if n > 0 {
+			sent, serr := m.Send(1, buffer[:n])
+			total += int64(sent)
+			if serr != nil {
+				return total, serr
+			}
+		}
+
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
+
+func transfer(name string, f *os.File, send func(*multiplex.Multiplex, *os.File) (int64, error)) {
+	a, b := tcp_pair()
+	tx := multiplex.NewMultiplex(a)
+	defer tx.Close()
+	defer b.Close()
+
+	tx.Enable(1, 0)
+	go io.Copy(io.Discard, b)
+
+	f.Seek(0, io.SeekStart)
+	start := time.Now()
+	sent, err := send(tx, f)
+	if err != nil {
+		log.Fatal(name, " ", err)
+	}
+
+	elapsed := time.Since(start)
+	fmt.Printf("%-9s: %8.1f MB/s\n", name, float64(sent)/elapsed.Seconds()/1e6)
+}
+
+func main() {
+	size := flag.Int("size", 256, "file size in MB")
+	flag.Parse()
+
+	log.SetOutput(io.Discard)
+
+	f, err := os.CreateTemp("", "bench_sendfile")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	data := make([]byte, 1024*1024)
+	for i := 0; i < *size; i++ {
+		f.Write(data)
+	}
+
+	transfer("read+Send", f, send_loop)
+	transfer("SendFile", f, func(m *multiplex.Multiplex, f *os.File) (int64, error) {
+		return m.SendFile(1, f, CHUNK)
+	})
+}
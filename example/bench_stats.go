@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../go"
+)
+
+// Measures how much metrics scrapers slow down the data path: a Write/Read
+// loop on a channel buffer, while goroutines read the counters in a tight
+// loop, either the connection totals (TotalStats, lock-free) or the channel
+// counters (ChannelStats, under the lock). Run it with GOMAXPROCS > SCRAPERS:
+// on fewer cores the scrapers mostly compete with the data path for the CPU.
+
+const (
+	SCRAPERS = 4
+)
+
+func data_loop(scrape func(m *multiplex.Multiplex), count int) (time.Duration, int64) {
+	a, _ := net.Pipe()
+	m := multiplex.NewMultiplex(a)
+	defer m.Close()
+
+	m.Enable(1, 0)
+
+	var stop atomic.Bool
+	var scrapes atomic.Int64
+	var wg sync.WaitGroup
+	if scrape != nil {
+		for i := 0; i < SCRAPERS; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for !stop.Load() {
+					scrape(m)
+					scrapes.Add(1)
+				}
+			}()
+		}
+	}
+
+	data := []byte("0123456789abcdef")
+	buffer := make([]byte, len(data))
+	start := time.Now()
+
+	for i := 0; i < count; i++ {
+		m.Write(1, data)
+		if _, err := m.Read(1, buffer); err != nil {
+			log.Fatal("read ", err)
+		}
+	}
+
+	elapsed := time.Since(start)
+	stop.Store(true)
+	wg.Wait()
+	return elapsed, scrapes.Load()
+}
+
+func main() {
+	count := flag.Int("n", 1000000, "iterations")
+	flag.Parse()
+
+	log.SetOutput(io.Discard)
+
+	for _, bench := range []struct {
+		name   string
+		scrape func(m *multiplex.Multiplex)
+	}{
+		{"no scraper", nil},
+		{"TotalStats", func(m *multiplex.Multiplex) { m.TotalStats() }},
+		{"ChannelStats", func(m *multiplex.Multiplex) { m.ChannelStats(1) }},
+	} {
+		elapsed, scrapes := data_loop(bench.scrape, *count)
+		fmt.Printf("%-12s: %6.1f ns/op, %10.0f scrapes/s\n", bench.name,
+			float64(elapsed.Nanoseconds())/float64(*count), float64(scrapes)/elapsed.Seconds())
+	}
+}
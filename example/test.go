@@ -109,7 +109,7 @@ func listenAndServe(port string, processor Processor) {
 		}
 
 		m := multiplex.NewMultiplex(conn)
-		m.EnableRange(0, multiplex.MAX_CHANNELS-1, 0)
+		m.EnableAll(0)
 		processor(m)
 	}
 }
@@ -122,7 +122,7 @@ func dialAndSend(port string, processor Processor) {
 	defer c.Close()
 
 	m := multiplex.NewMultiplex(c)
-	m.EnableRange(0, multiplex.MAX_CHANNELS-1, 0)
+	m.EnableAll(0)
 	processor(m)
 }
 
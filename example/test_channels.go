@@ -0,0 +1,526 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"../go"
+)
+
+// Checks the per-channel semantics of Receive, Select, Read and Clear, over
+// a net.Pipe.
+
+const (
+	FRAMES = 500
+)
+
+var failed = false
+
+func check(name string, ok bool, args ...interface{}) {
+	if ok {
+		log.Println("PASS", name)
+	} else {
+		log.Println("FAIL", name, fmt.Sprint(args...))
+		failed = true
+	}
+}
+
+func pipe(options ...multiplex.Option) (*multiplex.Multiplex, *multiplex.Multiplex) {
+	a, b := net.Pipe()
+	ma, mb := multiplex.NewMultiplex(a, options...), multiplex.NewMultiplex(b, options...)
+	ma.EnableAll(0)
+	mb.EnableAll(0)
+	return ma, mb
+}
+
+func concurrent_receivers() {
+	// two goroutines receiving on their own channel: each gets all its
+	// frames, in order, whichever reads them from the connection
+	tx, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	go func() {
+		for i := 0; i < FRAMES; i++ {
+			tx.Send(uint(1+i%2), []byte(fmt.Sprintf("%08d", i)))
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errors := make(chan error, 2)
+
+	for ch := uint(1); ch <= 2; ch++ {
+		wg.Add(1)
+		go func(ch uint) {
+			defer wg.Done()
+
+			buffer := make([]byte, 8)
+			for i := int(ch - 1); i < FRAMES; i += 2 {
+				n := 0
+				for n < len(buffer) {
+					r, err := rx.Receive(2*time.Second, ch, buffer[n:])
+					if err != nil {
+						errors <- fmt.Errorf("channel %d frame %d: %v", ch, i, err)
+						return
+					}
+					n += r
+				}
+
+				if string(buffer) != fmt.Sprintf("%08d", i) {
+					errors <- fmt.Errorf("channel %d frame %d: got %q", ch, i, buffer)
+					return
+				}
+			}
+		}(ch)
+	}
+
+	wg.Wait()
+	close(errors)
+
+	err := <-errors
+	check("concurrent receivers", err == nil, err)
+}
+
+func send_only() {
+	a, b := net.Pipe()
+	tx := multiplex.NewMultiplex(a, multiplex.WithDirection(multiplex.SEND_ONLY))
+	rx := multiplex.NewMultiplex(b)
+	defer tx.Close()
+	defer rx.Close()
+
+	tx.EnableAll(0)
+	rx.EnableAll(0)
+	go rx.Send(1, []byte("not for a producer"))
+
+	buffer := make([]byte, 100)
+	_, err := tx.Receive(100*time.Millisecond, 1, buffer)
+	check("send only, Receive", err == multiplex.CHANNEL_DIRECTION, err)
+
+	_, err = tx.ReceiveBuf(100*time.Millisecond, 1)
+	check("send only, ReceiveBuf", err == multiplex.CHANNEL_DIRECTION, err)
+
+	_, err = tx.Select(100 * time.Millisecond)
+	check("send only, Select", err == multiplex.CHANNEL_DIRECTION, err)
+}
+
+func clear_disabled() {
+	_, rx := pipe()
+	defer rx.Close()
+
+	rx.Disable(5)
+	check("Clear disabled channel", rx.Clear(5) == multiplex.CHANNEL_CLOSED)
+
+	rx.Write(6, []byte("cleared"))
+	err := rx.Clear(6)
+	check("Clear enabled channel", err == nil && rx.Length(6) == 0, err)
+}
+
+func ignore() {
+	// Ignore doesn't drop the data: it's still readable, and selected again
+	// after the renotify interval
+	_, rx := pipe()
+	defer rx.Close()
+
+	rx.Write(1, []byte("ignored"))
+	selected, err := rx.Select(100 * time.Millisecond)
+	check("Ignore, selected", err == nil && selected == 1, selected, err)
+
+	rx.Ignore(1)
+	_, err = rx.Select(50 * time.Millisecond)
+	check("Ignore, not selected again", err == multiplex.CHANNEL_TIMEOUT, err)
+	check("Ignore, data kept", string(rx.Dup(1)) == "ignored", string(rx.Dup(1)))
+
+	rx.SetRenotifyInterval(20 * time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	selected, err = rx.Select(100 * time.Millisecond)
+	check("Ignore, renotified", err == nil && selected == 1, selected, err)
+
+	buffer := make([]byte, 10)
+	n, err := rx.Read(1, buffer)
+	check("Ignore, read", err == nil && string(buffer[:n]) == "ignored", err)
+}
+
+func pause_resume() {
+	// frames received while paused are buffered, not delivered
+	tx, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	rx.Pause(1)
+	go func() {
+		for _, frame := range []string{"a", "b", "c"} {
+			tx.Send(1, []byte(frame))
+		}
+	}()
+
+	for rx.Length(1) < 3 {
+		if _, err := rx.Select(time.Second); err != multiplex.CHANNEL_IGNORED {
+			check("pause", false, err)
+			return
+		}
+	}
+
+	_, err := rx.Select(50 * time.Millisecond)
+	check("pause, not selected", err == multiplex.CHANNEL_TIMEOUT, err)
+
+	_, err = rx.Receive(50*time.Millisecond, 1, make([]byte, 10))
+	check("pause, Receive waits", err == multiplex.CHANNEL_TIMEOUT, err)
+
+	rx.Resume(1)
+	selected, err := rx.Select(time.Second)
+	check("resume", err == nil && selected == 1 && string(rx.Dup(1)) == "abc", selected, err)
+	rx.Clear(1)
+
+	go tx.Send(1, []byte("d"))
+	buffer := make([]byte, 10)
+	n, err := rx.Receive(time.Second, 1, buffer)
+	check("resume, next frame", err == nil && string(buffer[:n]) == "d", err)
+}
+
+func max_message() {
+	tx, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	check("max message, invalid", rx.SetChannelMaxMessage(1, 0) == multiplex.INVALID_ARGUMENT)
+
+	rx.SetChannelMaxMessage(1, 4096)
+	go func() {
+		tx.Send(1, make([]byte, 5000))
+		tx.Send(2, make([]byte, 100000))
+		tx.Send(1, make([]byte, 4096))
+	}()
+
+	selected, err := rx.Select(time.Second)
+	check("max message, too large", err == multiplex.CHANNEL_FRAME_TOO_LARGE && selected == 1 && rx.Length(1) == 0, selected, err)
+
+	received := 0
+	buffer := make([]byte, 100000)
+	for received < len(buffer) {
+		n, err := rx.Receive(time.Second, 2, buffer[received:])
+		if err != nil {
+			break
+		}
+		received += n
+	}
+	check("max message, unlimited channel", received == len(buffer), received)
+
+	frame, err := rx.ReadFrame(time.Second, 1)
+	check("max message, at the limit", err == nil && len(frame) == 4096, err, len(frame))
+}
+
+func receive_and_select() {
+	// data consumed by Receive is not selected anymore
+	tx, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	go func() {
+		tx.Send(1, []byte("abcd"))
+		tx.Send(2, []byte("x"))
+	}()
+
+	// buffers the frame for channel 1 on the way
+	buffer := make([]byte, 2)
+	n, err := rx.Receive(time.Second, 2, buffer)
+	check("Receive, other channel", err == nil && string(buffer[:n]) == "x", err)
+
+	n, err = rx.Receive(time.Second, 1, buffer)
+	check("Receive, buffered", err == nil && string(buffer[:n]) == "ab", err)
+
+	selected, err := rx.Select(100 * time.Millisecond)
+	check("Select after Receive, rest of the data", err == nil && selected == 1 && rx.Length(1) == 2, selected, err)
+
+	go tx.Send(1, []byte("ef"))
+	for rx.Length(1) < 4 {
+		rx.Select(time.Second)
+	}
+
+	buffer = make([]byte, 10)
+	n, err = rx.Receive(time.Second, 1, buffer)
+	check("Receive, all the data", err == nil && string(buffer[:n]) == "cdef", err)
+
+	_, err = rx.Select(50 * time.Millisecond)
+	check("Select after Receive, nothing left", err == multiplex.CHANNEL_TIMEOUT, err)
+}
+
+func buffer_limit() {
+	// a flood over 128 channels: the channel buffers never grow past the
+	// total limit, and the frames that don't fit are dropped
+	const (
+		LIMIT  = 64 * 1024
+		FRAME  = 1000
+		FLOODS = 4000
+	)
+
+	a, b := net.Pipe()
+	tx, rx := multiplex.NewMultiplex(a), multiplex.NewMultiplex(b)
+	defer tx.Close()
+	defer rx.Close()
+
+	rx.SetTotalBufferLimit(LIMIT)
+	rx.EnableRange(0, 127, 256)
+	rx.StartReader()
+
+	frame := make([]byte, FRAME)
+	bounded := true
+	for i := 0; i < FLOODS; i++ {
+		tx.Send(uint(i%128), frame)
+		if rx.TotalBufferSize() > LIMIT {
+			bounded = false
+		}
+	}
+
+	for rx.TotalStats().FramesReceived < FLOODS {
+		time.Sleep(time.Millisecond)
+	}
+
+	dropped := int(rx.ErrorCounts()["buffer_limit"])
+	buffered := 0
+	for ch := uint(0); ch < 128; ch++ {
+		buffered += rx.Length(ch)
+	}
+
+	check("total buffer limit", bounded && rx.TotalBufferSize() <= LIMIT, rx.TotalBufferSize())
+	check("total buffer limit, dropped", dropped > 0 && buffered == (FLOODS-dropped)*FRAME, "dropped ", dropped, " buffered ", buffered)
+}
+
+func channel_eof() {
+	// closing one channel doesn't affect the others
+	a, b := net.Pipe()
+	tx, rx := multiplex.NewMultiplex(a, multiplex.WithControlFrames()), multiplex.NewMultiplex(b, multiplex.WithControlFrames())
+	defer tx.Close()
+	defer rx.Close()
+
+	tx.EnableAll(0)
+	rx.EnableAll(0)
+	rx.StartReader()
+
+	tx.Send(1, []byte("one"))
+	tx.CloseWrite(1)
+	tx.CloseChannel(2, 4000, "bye")
+	tx.Send(3, []byte("three"))
+
+	buffer := make([]byte, 10)
+	n, err := rx.Receive(time.Second, 1, buffer)
+	check("channel EOF, data first", err == nil && string(buffer[:n]) == "one", err)
+
+	_, err = rx.Receive(time.Second, 1, buffer)
+	check("channel EOF", err == multiplex.CHANNEL_EOF && errors.Is(err, io.EOF), err)
+
+	var closed *multiplex.CloseError
+	_, err = rx.Receive(time.Second, 2, buffer)
+	check("channel EOF, close error", errors.As(err, &closed) && closed.Code == 4000 && errors.Is(err, multiplex.CHANNEL_EOF), err)
+
+	n, err = rx.Receive(time.Second, 3, buffer)
+	check("channel EOF, other channels", err == nil && string(buffer[:n]) == "three", err)
+
+	go tx.Send(3, []byte("more"))
+	n, err = rx.Receive(time.Second, 3, buffer)
+	check("channel EOF, other channels keep working", err == nil && string(buffer[:n]) == "more", err)
+
+	tx.Close()
+	_, err = rx.Receive(time.Second, 3, buffer)
+	check("connection closed", err == multiplex.CHANNEL_CLOSED, err)
+}
+
+func non_blocking() {
+	tx, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	rx.SetNonBlocking(1, true)
+	buffer := make([]byte, 10)
+
+	start := time.Now()
+	_, err := rx.Receive(0, 1, buffer)
+	check("non-blocking, nothing buffered", err == multiplex.CHANNEL_WOULDBLOCK && time.Since(start) < 50*time.Millisecond, err)
+
+	// the frames are read by someone else
+	go tx.Send(1, []byte("data"))
+	rx.Select(time.Second)
+	n, err := rx.Receive(0, 1, buffer)
+	check("non-blocking, buffered", err == nil && string(buffer[:n]) == "data", err)
+
+	rx.SetNonBlocking(1, false)
+	_, err = rx.Receive(50*time.Millisecond, 1, buffer)
+	check("blocking, waits", err == multiplex.CHANNEL_TIMEOUT, err)
+
+	go tx.Send(1, []byte("more"))
+	n, err = rx.Receive(time.Second, 1, buffer)
+	check("blocking, reads the connection", err == nil && string(buffer[:n]) == "more", err)
+}
+
+func receive_priority() {
+	// the high priority channel is selected first, whatever the order the
+	// data arrived in
+	_, rx := pipe()
+	defer rx.Close()
+
+	rx.SetReceivePriority(9, 10)
+	rx.SetReceivePriority(3, -1)
+
+	for round := 0; round < 20; round++ {
+		rx.Write(3, []byte("low"))
+		rx.Write(uint(1+round%2), []byte("bulk"))
+		rx.Write(9, []byte("control"))
+		rx.Write(uint(2-round%2), []byte("bulk"))
+
+		var order []uint
+		for i := 0; i < 4; i++ {
+			selected, err := rx.Select(100 * time.Millisecond)
+			if err != nil {
+				break
+			}
+			order = append(order, selected)
+			rx.Clear(selected)
+		}
+
+		if len(order) != 4 || order[0] != 9 || order[3] != 3 {
+			check("receive priority", false, "round ", round, " ", order)
+			return
+		}
+	}
+
+	check("receive priority", true)
+}
+
+func reordered_fragments() {
+	_, rx := pipe()
+	defer rx.Close()
+
+	rx.SetPositional(1, true)
+	message := "0123456789abcdef"
+
+	rx.WriteAt(1, []byte(message[8:12]), 8)
+	_, err := rx.Select(50 * time.Millisecond)
+	check("fragments, gap", err == multiplex.CHANNEL_TIMEOUT && rx.Length(1) == 0, err)
+
+	rx.WriteAt(1, []byte(message[0:4]), 0)
+	selected, err := rx.Select(100 * time.Millisecond)
+	check("fragments, contiguous start", err == nil && selected == 1 && string(rx.Dup(1)) == "0123", selected, err)
+
+	rx.WriteAt(1, []byte(message[12:]), 12)
+	rx.WriteAt(1, []byte(message[0:6]), 0) // overlapping, already written
+	rx.WriteAt(1, []byte(message[4:8]), 4)
+	check("fragments, reassembled", string(rx.Dup(1)) == message, string(rx.Dup(1)))
+}
+
+func reallocation_rate() {
+	// frames much larger than the buffer usually holds make it grow and
+	// shrink over and over
+	_, rx := pipe()
+	defer rx.Close()
+
+	rx.Disable(100)
+	rx.Enable(100, 16)
+	rx.Disable(101)
+	rx.Enable(101, 4096)
+
+	large := make([]byte, 1000)
+	buffer := make([]byte, 1000)
+	for i := 0; i < 50; i++ {
+		for _, ch := range []uint{100, 101} {
+			rx.Write(ch, large)
+			rx.Read(ch, buffer)
+			rx.Write(ch, large[:10])
+			rx.Read(ch, buffer)
+		}
+	}
+
+	check("reallocation rate, undersized", rx.ReallocationRate(100) >= 5, rx.ReallocationRate(100))
+	check("reallocation rate, sized", rx.ReallocationRate(101) == 0, rx.ReallocationRate(101))
+}
+
+func read_frame_drain() {
+	// the ReadFrame that reaches the end of a drained channel disables it,
+	// while other goroutines enable and disable channels (run with -race)
+	_, rx := pipe()
+	defer rx.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			rx.Disable(200)
+			rx.Enable(200, 0)
+		}
+	}()
+
+	ok := true
+	for round := 0; round < 200 && ok; round++ {
+		rx.Write(7, []byte("frame"))
+		rx.CloseChannelAfterDrain(7, 0, "")
+
+		frame, err := rx.ReadFrame(time.Second, 7)
+		ok = err == nil && string(frame) == "frame"
+		if _, err = rx.ReadFrame(time.Second, 7); err != multiplex.CHANNEL_EOF {
+			ok = false
+		}
+
+		// let the other goroutine take the lock before this one does
+		time.Sleep(100 * time.Microsecond)
+		rx.Enable(7, 0)
+	}
+
+	close(stop)
+	wg.Wait()
+	check("ReadFrame to EOF, concurrent Enable and Disable", ok)
+}
+
+func release_sensitive() {
+	// the storage of a Buffer from a sensitive channel is zeroed on
+	// Release, the other channels are not
+	_, rx := pipe()
+	defer rx.Close()
+
+	rx.SetSensitive(1, true)
+	for _, ch := range []uint{1, 2} {
+		rx.Write(ch, []byte("secret"))
+		b, err := rx.ReceiveBuf(time.Second, ch)
+		if err != nil {
+			check("ReceiveBuf", false, err)
+			return
+		}
+
+		data := b.Bytes()
+		b.Release()
+		b.Release()
+		check(fmt.Sprint("Release, channel ", ch), (string(data) == "secret") == (ch == 2) && b.Bytes() == nil, data)
+	}
+}
+
+func main() {
+	concurrent_receivers()
+	send_only()
+	clear_disabled()
+	ignore()
+	pause_resume()
+	max_message()
+	receive_and_select()
+	buffer_limit()
+	channel_eof()
+	non_blocking()
+	receive_priority()
+	reordered_fragments()
+	reallocation_rate()
+	read_frame_drain()
+	release_sensitive()
+
+	if failed {
+		os.Exit(1)
+	}
+}
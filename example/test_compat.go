@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"../go"
+)
+
+// Runs the flows of test.go (Select+Dup+Clear, Send+Receive) and
+// test_stream.go (Streams over RunLoop) over a local connection, with a
+// bounded number of messages, once reading the connection from Select and
+// once with the background reader (see StartReader): both must behave the
+// same.
+
+const (
+	MESSAGES = 200
+	STREAMS  = 16
+)
+
+var failed = false
+
+func check(name string, ok bool, args ...interface{}) {
+	if ok {
+		log.Println("PASS", name)
+	} else {
+		log.Println("FAIL", name, fmt.Sprint(args...))
+		failed = true
+	}
+}
+
+func connect(reader bool) (*multiplex.Multiplex, *multiplex.Multiplex) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, server := multiplex.NewMultiplex(conn), multiplex.NewMultiplex(<-accepted)
+	client.EnableAll(0)
+	server.EnableAll(0)
+	if reader {
+		client.StartReader()
+		server.StartReader()
+	}
+
+	return client, server
+}
+
+func message(i int) string {
+	ch := i % (multiplex.MAX_CHANNELS - 1)
+	return fmt.Sprintf("Hello on Channel %s", strings.Repeat(fmt.Sprintf("%d ", ch), i%50))
+}
+
+// multichannel is test.go -run multichannel: the receiver selects, dups and
+// clears.
+func multichannel(name string, reader bool) {
+	client, server := connect(reader)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for i := 0; i < MESSAGES; i++ {
+			client.Send(uint(i%(multiplex.MAX_CHANNELS-1)), []byte(message(i)))
+		}
+	}()
+
+	received := map[uint][]byte{}
+	total, expected := 0, 0
+	for i := 0; i < MESSAGES; i++ {
+		expected += len(message(i))
+	}
+
+	for total < expected {
+		selected, err := server.Select(2 * time.Second)
+		if err != nil {
+			check(name, false, "Select ", err)
+			return
+		}
+
+		buffer := server.Dup(selected)
+		server.Clear(selected)
+		if server.Length(selected) != 0 {
+			check(name, false, "Clear left ", server.Length(selected))
+			return
+		}
+
+		received[selected] = append(received[selected], buffer...)
+		total += len(buffer)
+	}
+
+	for i := 0; i < multiplex.MAX_CHANNELS-1; i++ {
+		var want []byte
+		for j := i; j < MESSAGES; j += multiplex.MAX_CHANNELS - 1 {
+			want = append(want, message(j)...)
+		}
+		if !bytes.Equal(received[uint(i)], want) {
+			check(name, false, "channel ", i)
+			return
+		}
+	}
+
+	check(name, true)
+}
+
+// echo is test.go -run echo: Send+Receive on one side, Select+Dup+Clear+Send
+// on the other.
+func echo(name string, reader bool) {
+	client, server := connect(reader)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			selected, err := server.Select(2 * time.Second)
+			if err == multiplex.CHANNEL_CLOSED {
+				return
+			}
+			if err == nil {
+				buffer := server.Dup(selected)
+				server.Clear(selected)
+				server.Send(selected, buffer)
+			}
+		}
+	}()
+
+	for i := 0; i < MESSAGES; i++ {
+		ch := uint(i % (multiplex.MAX_CHANNELS - 1))
+		sent := message(i)
+		if _, err := client.Send(ch, []byte(sent)); err != nil {
+			check(name, false, "Send ", err)
+			return
+		}
+
+		buffer := make([]byte, len(sent))
+		n := 0
+		for n < len(sent) {
+			r, err := client.Receive(2*time.Second, ch, buffer[n:])
+			if err != nil {
+				check(name, false, "Receive ", err)
+				return
+			}
+			n += r
+		}
+
+		if string(buffer) != sent {
+			check(name, false, "echo ", i)
+			return
+		}
+	}
+
+	check(name, true)
+}
+
+// streams is test_stream.go: a Stream per channel on both sides, echoing,
+// over RunLoop.
+func streams(name string, reader bool) {
+	client, server := connect(reader)
+	defer client.Close()
+	defer server.Close()
+
+	go client.RunLoop()
+	go server.RunLoop()
+
+	for i := 0; i < STREAMS; i++ {
+		go func(ch uint) {
+			stream := multiplex.NewStream(server, ch)
+			buffer := make([]byte, 1024)
+			for {
+				n, err := stream.Read(buffer)
+				if err != nil {
+					return
+				}
+				stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
+				stream.Write(buffer[:n])
+			}
+		}(uint(i))
+	}
+
+	var wg sync.WaitGroup
+	errors := make(chan error, STREAMS)
+
+	for i := 0; i < STREAMS; i++ {
+		wg.Add(1)
+		go func(ch uint) {
+			defer wg.Done()
+
+			stream := multiplex.NewStream(client, ch)
+			stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+			for j := 0; j < MESSAGES/STREAMS; j++ {
+				sent := fmt.Sprintf("Echo on Channel %d %s.", ch, strings.Repeat("the quick brown fox jumps over the lazy dog ", j))
+				if _, err := stream.Write([]byte(sent)); err != nil {
+					errors <- err
+					return
+				}
+
+				buffer := make([]byte, len(sent))
+				n := 0
+				for n < len(sent) {
+					r, err := stream.Read(buffer[n:])
+					if err != nil {
+						errors <- err
+						return
+					}
+					n += r
+				}
+
+				if string(buffer) != sent {
+					errors <- fmt.Errorf("channel %d: got %q", ch, buffer)
+					return
+				}
+			}
+		}(uint(i))
+	}
+
+	wg.Wait()
+	close(errors)
+
+	err := <-errors
+	check(name, err == nil, err)
+}
+
+func main() {
+	for _, reader := range []bool{false, true} {
+		suffix := ""
+		if reader {
+			suffix = " (background reader)"
+		}
+
+		multichannel("multichannel"+suffix, reader)
+		echo("echo"+suffix, reader)
+		streams("streams"+suffix, reader)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
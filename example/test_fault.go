@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"../go"
+	"../go/faultconn"
+)
+
+// Exercises the handling of transport faults, injected with a FaultConn
+// over a net.Pipe, so that each case is deterministic.
+
+var failed = false
+
+func check(name string, ok bool, args ...interface{}) {
+	if ok {
+		log.Println("PASS", name)
+	} else {
+		log.Println("FAIL", name, fmt.Sprint(args...))
+		failed = true
+	}
+}
+
+// temporaryError is a net.Error that is worth retrying.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "resource temporarily unavailable" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func pipe(options ...multiplex.Option) (*faultconn.FaultConn, *multiplex.Multiplex, *faultconn.FaultConn, *multiplex.Multiplex) {
+	a, b := net.Pipe()
+	fa, fb := faultconn.New(a), faultconn.New(b)
+	ma, mb := multiplex.NewMultiplex(fa, options...), multiplex.NewMultiplex(fb, options...)
+	ma.EnableAll(0)
+	mb.EnableAll(0)
+	return fa, ma, fb, mb
+}
+
+func short_writes() {
+	fa, tx, _, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	fa.SetWriteChunkSize(3)
+	message := []byte("the quick brown fox jumps over the lazy dog")
+
+	go func() {
+		for ch := uint(0); ch < 10; ch++ {
+			if _, err := tx.Send(ch, message); err != nil {
+				log.Println("short_writes", "Send", err)
+			}
+		}
+	}()
+
+	for ch := uint(0); ch < 10; ch++ {
+		buffer := make([]byte, 100)
+		n, err := rx.Receive(time.Second, ch, buffer)
+		if err != nil || !bytes.Equal(buffer[:n], message) {
+			check("short writes", false, ch, err, string(buffer[:n]))
+			return
+		}
+	}
+
+	_, writes := fa.Counts()
+	check("short writes", writes > 10, "writes ", writes)
+}
+
+func short_reads() {
+	_, tx, fb, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	fb.SetReadChunkSize(1)
+	message := []byte("one byte at a time")
+	go tx.Send(5, message)
+
+	selected, err := rx.Select(time.Second)
+	check("short reads", err == nil && selected == 5 && bytes.Equal(rx.Dup(5), message), selected, err)
+}
+
+func partial_header() {
+	// a read deadline that expires in the middle of a header: with a
+	// read buffer the bytes already read are kept, and the next Select
+	// resumes the frame
+	_, tx, fb, rx := pipe(multiplex.WithReadBuffer(4096))
+	defer tx.Close()
+	defer rx.Close()
+
+	fb.FailReadAfter(3, os.ErrDeadlineExceeded)
+	go tx.Send(7, []byte("resumed"))
+
+	_, err := rx.Select(time.Second)
+	check("partial header timeout", err == multiplex.CHANNEL_TIMEOUT, err)
+
+	selected, err := rx.Select(time.Second)
+	check("partial header resume", err == nil && selected == 7 && string(rx.Dup(7)) == "resumed", selected, err)
+}
+
+func slow_peer() {
+	fa, tx, _, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	fa.DelayNextWrite(200 * time.Millisecond)
+	go tx.Send(1, []byte("late"))
+
+	_, err := rx.Select(50 * time.Millisecond)
+	check("slow peer timeout", err == multiplex.CHANNEL_TIMEOUT, err)
+
+	selected, err := rx.Select(time.Second)
+	check("slow peer", err == nil && selected == 1, selected, err)
+}
+
+func temporary_error() {
+	fa, tx, _, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	tx.SetWriteRetry(2, time.Millisecond)
+	fa.InjectWriteError(temporaryError{})
+	go tx.Send(2, []byte("retried"))
+
+	buffer := make([]byte, 10)
+	n, err := rx.Receive(time.Second, 2, buffer)
+	check("temporary error retry", err == nil && string(buffer[:n]) == "retried", err)
+}
+
+func partial_write() {
+	// a write that fails after part of the frame went out leaves the
+	// stream without frame boundaries
+	fa, tx, _, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	go rx.Select(time.Second)
+
+	fa.FailWriteAfter(2, errors.New("broken pipe"))
+	_, err := tx.Send(3, []byte("cut"))
+	check("partial write", err == multiplex.CHANNEL_DESYNC, err)
+
+	_, err = tx.Send(3, []byte("after"))
+	check("partial write, next send", err == multiplex.CHANNEL_DESYNC, err)
+}
+
+func corruption() {
+	_, tx, fb, rx := pipe(multiplex.WithMagicHeader())
+	defer tx.Close()
+	defer rx.Close()
+
+	fb.CorruptNextByte()
+	go tx.Send(4, []byte("garbled"))
+
+	_, err := rx.Select(time.Second)
+	check("corrupted header", err == multiplex.CHANNEL_PROTOCOL, err)
+}
+
+func resync() {
+	// with WithResync the corrupted frame is skipped, up to the next
+	// frame's magic byte
+	_, tx, fb, rx := pipe(multiplex.WithMagicHeader(), multiplex.WithResync(64))
+	defer tx.Close()
+	defer rx.Close()
+
+	fb.CorruptNextByte()
+	go func() {
+		tx.Send(4, []byte("garbled"))
+		tx.Send(5, []byte("recovered"))
+	}()
+
+	_, err := rx.Select(time.Second)
+	check("resync", err == multiplex.CHANNEL_RESYNC, err)
+
+	selected, err := rx.Select(time.Second)
+	check("resync recovery", err == nil && selected == 5 && string(rx.Dup(5)) == "recovered", selected, err)
+}
+
+func sequence_gap() {
+	// with sequence numbers a lost frame is reported by the next one
+	fa, tx, _, rx := pipe(multiplex.WithSequenceNumbers())
+	defer tx.Close()
+	defer rx.Close()
+
+	go func() {
+		tx.Send(6, []byte("first"))
+		fa.DropNextWrite()
+		tx.Send(6, []byte("lost"))
+		tx.Send(6, []byte("third"))
+	}()
+
+	selected, err := rx.Select(time.Second)
+	check("sequence", err == nil && selected == 6 && string(rx.Dup(6)) == "first", selected, err)
+	rx.Clear(6)
+
+	var gap *multiplex.SequenceError
+	selected, err = rx.Select(time.Second)
+	check("sequence gap", errors.As(err, &gap) && gap.Channel == 6 && gap.Expected == 1 && gap.Received == 2, selected, err)
+	check("sequence gap, data kept", string(rx.Dup(6)) == "third", string(rx.Dup(6)))
+	check("sequence gap, counted", rx.ErrorCounts()["sequence"] == 1, rx.ErrorCounts())
+}
+
+func sub_framing() {
+	// messages read one byte at a time, with a deadline expiring in the
+	// middle of the second message: ReadMessage returns the error, and the
+	// next call resumes the message
+	a, b := net.Pipe()
+	fb := faultconn.New(b)
+	defer a.Close()
+	defer fb.Close()
+
+	messages := []string{"first message", "second message", "", "last"}
+	go func() {
+		encoder := multiplex.NewFrameEncoder(a)
+		for _, msg := range messages {
+			encoder.WriteMessage([]byte(msg))
+		}
+		a.Close()
+	}()
+
+	fb.SetReadChunkSize(1)
+	decoder := multiplex.NewFrameDecoder(fb)
+
+	msg, err := decoder.ReadMessage()
+	check("sub-framing, partial reads", err == nil && string(msg) == messages[0], err, string(msg))
+
+	fb.FailReadAfter(6, os.ErrDeadlineExceeded)
+	_, err = decoder.ReadMessage()
+	check("sub-framing, deadline", errors.Is(err, os.ErrDeadlineExceeded), err)
+
+	for _, want := range messages[1:] {
+		msg, err = decoder.ReadMessage()
+		if err != nil || string(msg) != want {
+			check("sub-framing, resumed", false, err, " ", string(msg))
+			return
+		}
+	}
+	check("sub-framing, resumed", true)
+
+	_, err = decoder.ReadMessage()
+	check("sub-framing, EOF", err == io.EOF, err)
+}
+
+func version_mismatch() {
+	a, b := net.Pipe()
+	tx := multiplex.NewMultiplex(a, multiplex.WithVersion(2))
+	rx := multiplex.NewMultiplex(b, multiplex.WithVersion(multiplex.PROTOCOL_VERSION))
+	defer tx.Close()
+	defer rx.Close()
+
+	tx.EnableAll(0)
+	rx.EnableAll(0)
+	go tx.Send(1, []byte("from the future"))
+
+	_, err := rx.Select(time.Second)
+	check("version mismatch", err == multiplex.CHANNEL_VERSION, err)
+
+	_, tx, _, rx = pipe(multiplex.WithVersion(multiplex.PROTOCOL_VERSION))
+	defer tx.Close()
+	defer rx.Close()
+
+	go tx.Send(1, []byte("same version"))
+	selected, err := rx.Select(time.Second)
+	check("version match", err == nil && selected == 1 && string(rx.Dup(1)) == "same version", selected, err)
+}
+
+func channel_over_max() {
+	// the peer has more channels than the receiver
+	a, b := net.Pipe()
+	tx := multiplex.NewMultiplexEx(a, multiplex.MAX_CHANNELS)
+	rx := multiplex.NewMultiplexEx(b, 16)
+	defer tx.Close()
+	defer rx.Close()
+
+	tx.EnableAll(0)
+	rx.EnableAll(0)
+	go tx.Send(20, []byte("out of range"))
+
+	_, err := rx.Select(time.Second)
+	check("channel over max channels", err == multiplex.CHANNEL_PROTOCOL, err)
+}
+
+func truncated_frame() {
+	// the connection is cut in the middle of a payload: a clean close by
+	// default, a truncated frame with WithStrictEOF
+	for _, strict := range []bool{false, true} {
+		options := []multiplex.Option{}
+		name, expected := "cut frame", multiplex.CHANNEL_CLOSED
+		if strict {
+			options = append(options, multiplex.WithStrictEOF())
+			name, expected = "cut frame, strict", multiplex.CHANNEL_TRUNCATED
+		}
+
+		fa, tx, _, rx := pipe(options...)
+
+		go func() {
+			// the 5 bytes header and the first 3 bytes of the payload
+			fa.FailWriteAfter(8, errors.New("connection reset"))
+			tx.Send(2, []byte("truncated payload"))
+			tx.Close()
+		}()
+
+		_, err := rx.Select(time.Second)
+		check(name, err == expected, err)
+		if strict {
+			check(name+", ErrUnexpectedEOF", errors.Is(err, io.ErrUnexpectedEOF), err)
+		}
+		check(name+", nothing buffered", rx.Length(2) == 0, rx.Length(2))
+
+		rx.Close()
+	}
+}
+
+// emptyConn is a net.Conn whose reads return no data and no error, empty
+// times before reading from the connection (forever if negative).
+type emptyConn struct {
+	net.Conn
+	empty int
+}
+
+func (c *emptyConn) Read(b []byte) (int, error) {
+	if c.empty != 0 {
+		c.empty--
+		return 0, nil
+	}
+
+	return c.Conn.Read(b)
+}
+
+func empty_reads() {
+	limit := multiplex.EMPTY_READ_LIMIT
+	defer func() { multiplex.EMPTY_READ_LIMIT = limit }()
+	multiplex.EMPTY_READ_LIMIT = 10
+
+	a, b := net.Pipe()
+	tx, rx := multiplex.NewMultiplex(a), multiplex.NewMultiplex(&emptyConn{Conn: b, empty: 5})
+	tx.EnableAll(0)
+	rx.EnableAll(0)
+
+	go tx.Send(1, []byte("after empty reads"))
+	selected, err := rx.Select(time.Second)
+	check("empty reads", err == nil && selected == 1 && string(rx.Dup(1)) == "after empty reads", selected, err)
+	tx.Close()
+	rx.Close()
+
+	a, b = net.Pipe()
+	tx, rx = multiplex.NewMultiplex(a), multiplex.NewMultiplex(&emptyConn{Conn: b, empty: -1})
+	defer tx.Close()
+	defer rx.Close()
+	rx.EnableAll(0)
+
+	start := time.Now()
+	_, err = rx.Select(time.Second)
+	check("only empty reads", err == multiplex.CHANNEL_CLOSED && time.Since(start) < time.Second, err, " ", time.Since(start))
+}
+
+func stalled_peer() {
+	// a peer that doesn't read: with a send queue limit, the memory held
+	// by the queued frames stays bounded
+	const (
+		LIMIT = 4096
+		FRAME = 100
+	)
+
+	for _, policy := range []multiplex.QueuePolicy{multiplex.QUEUE_ERROR, multiplex.QUEUE_BLOCK} {
+		name := "stalled peer, queue error"
+		if policy == multiplex.QUEUE_BLOCK {
+			name = "stalled peer, queue block"
+		}
+
+		a, _ := net.Pipe()
+		tx := multiplex.NewMultiplex(a)
+		tx.EnableAll(0)
+		tx.SetWriteCoalesce(time.Millisecond)
+		tx.SetSendQueueLimit(LIMIT, policy)
+
+		var lock sync.Mutex
+		accepted, full := 0, 0
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+
+			frame := make([]byte, FRAME)
+			for i := 0; i < 10000; i++ {
+				_, err := tx.Send(uint(i%10), frame)
+				if err == multiplex.CHANNEL_QUEUE_FULL {
+					lock.Lock()
+					full++
+					lock.Unlock()
+					continue
+				} else if err != nil {
+					return
+				}
+
+				lock.Lock()
+				accepted += FRAME
+				lock.Unlock()
+			}
+		}()
+
+		time.Sleep(300 * time.Millisecond)
+
+		lock.Lock()
+		// the queue, and the frames being written to the peer
+		bounded := accepted <= 2*LIMIT
+		check(name, bounded && (policy == multiplex.QUEUE_BLOCK || full > 0), "accepted ", accepted, " full ", full)
+		lock.Unlock()
+
+		tx.Close()
+		<-done
+	}
+}
+
+func close_during_write() {
+	// the lock is released while the close frame is written: the channel
+	// can be disabled, or replaced, in the meantime
+	fa, tx, _, rx := pipe(multiplex.WithControlFrames())
+	defer tx.Close()
+	defer rx.Close()
+
+	rx.StartReader()
+
+	tx.Write(3, []byte("buffered"))
+	fa.DelayNextWrite(100 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() { done <- tx.CloseChannelAfterDrain(3, 4000, "bye") }()
+
+	time.Sleep(20 * time.Millisecond)
+	tx.Disable(3)
+	err := <-done
+	check("CloseChannelAfterDrain, disabled while writing", err == nil && tx.ChannelFree(3) == -1, err)
+
+	fa.DelayNextWrite(100 * time.Millisecond)
+	go func() { done <- tx.CloseChannel(4, 4000, "bye") }()
+
+	time.Sleep(20 * time.Millisecond)
+	tx.Disable(4)
+	tx.Enable(4, 0)
+	err = <-done
+	check("CloseChannel, enabled again while writing", err == nil && tx.ChannelFree(4) >= 0, err)
+}
+
+func main() {
+	short_writes()
+	short_reads()
+	partial_header()
+	slow_peer()
+	temporary_error()
+	partial_write()
+	corruption()
+	resync()
+	sequence_gap()
+	sub_framing()
+	version_mismatch()
+	channel_over_max()
+	truncated_frame()
+	empty_reads()
+	stalled_peer()
+	close_during_write()
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../go"
+)
+
+// Serves HTTP/2 (without TLS, see http.Protocols) over a single Stream,
+// and makes requests to it over the matching Stream on the other side:
+// the HTTP/2 server and transport exercise the net.Conn behaviour of
+// Stream (blocking Read, deadlines, io.EOF on close).
+
+const (
+	CHANNEL  = 5
+	REQUESTS = 20
+)
+
+var failed = false
+
+func check(name string, ok bool, args ...interface{}) {
+	if ok {
+		log.Println("PASS", name)
+	} else {
+		log.Println("FAIL", name, fmt.Sprint(args...))
+		failed = true
+	}
+}
+
+// streamListener returns a single connection, then blocks until closed.
+type streamListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *streamListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func connect() (*multiplex.Multiplex, *multiplex.Multiplex) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client := multiplex.NewMultiplex(conn, multiplex.WithControlFrames())
+	server := multiplex.NewMultiplex(<-accepted, multiplex.WithControlFrames())
+	client.Enable(CHANNEL, 0)
+	server.Enable(CHANNEL, 0)
+	return client, server
+}
+
+func main() {
+	client, server := connect()
+	defer client.Close()
+	defer server.Close()
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+
+	listener := &streamListener{conns: make(chan net.Conn, 1), done: make(chan struct{})}
+	listener.conns <- multiplex.NewStream(server, CHANNEL)
+
+	httpServer := &http.Server{
+		Protocols:   &protocols,
+		ReadTimeout: 5 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, "%s %s", r.Proto, body)
+		}),
+	}
+	go httpServer.Serve(listener)
+	defer httpServer.Close()
+
+	var dials atomic.Int32
+	transport := &http.Transport{
+		Protocols: &protocols,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return multiplex.NewStream(client, CHANNEL), nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	httpClient := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+	request := func(i int) error {
+		body := fmt.Sprintf("request %d %s", i, strings.Repeat("x", i*100))
+		resp, err := httpClient.Post("http://multiplex/", "text/plain", strings.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.ProtoMajor != 2 || string(data) != "HTTP/2.0 "+body {
+			return fmt.Errorf("request %d: %s %q", i, resp.Proto, data)
+		}
+		return nil
+	}
+
+	err := request(0)
+	check("HTTP/2 request", err == nil, err)
+
+	// concurrent requests are HTTP/2 streams on the same connection
+	var wg sync.WaitGroup
+	errors := make(chan error, REQUESTS)
+	for i := 1; i <= REQUESTS; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := request(i); err != nil {
+				errors <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errors)
+
+	err = <-errors
+	check("concurrent HTTP/2 requests", err == nil && dials.Load() == 1, err, " dials ", dials.Load())
+
+	if failed {
+		os.Exit(1)
+	}
+}
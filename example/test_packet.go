@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"../go"
+)
+
+// Checks the packet mode (see NewMultiplexPacket) over UDP on the loopback.
+
+var failed = false
+
+func check(name string, ok bool, args ...interface{}) {
+	if ok {
+		log.Println("PASS", name)
+	} else {
+		log.Println("FAIL", name, fmt.Sprint(args...))
+		failed = true
+	}
+}
+
+func udp_pair() (*multiplex.Multiplex, *multiplex.Multiplex) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tx := multiplex.NewMultiplexPacket(client.(net.PacketConn))
+	rx := multiplex.NewMultiplexPacket(server)
+	tx.EnableAll(0)
+	rx.EnableAll(0)
+	return tx, rx
+}
+
+func round_trip() {
+	tx, rx := udp_pair()
+	defer tx.Close()
+	defer rx.Close()
+
+	tx.Send(1, []byte("datagram"))
+	buffer := make([]byte, 100)
+	n, err := rx.Receive(time.Second, 1, buffer)
+	check("packet round trip", err == nil && string(buffer[:n]) == "datagram", err)
+}
+
+func deadline_cleared() {
+	// a blocking Receive after a Select that timed out waits, instead of
+	// failing on the deadline left by the Select
+	tx, rx := udp_pair()
+	defer tx.Close()
+	defer rx.Close()
+
+	_, err := rx.Select(50 * time.Millisecond)
+	check("packet Select timeout", err == multiplex.CHANNEL_TIMEOUT, err)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tx.Send(1, []byte("late"))
+	}()
+
+	buffer := make([]byte, 100)
+	start := time.Now()
+	n, err := rx.Receive(0, 1, buffer)
+	check("packet blocking Receive after a timeout", err == nil && string(buffer[:n]) == "late", err, " after ", time.Since(start))
+}
+
+func main() {
+	round_trip()
+	deadline_cleared()
+
+	if failed {
+		os.Exit(1)
+	}
+}
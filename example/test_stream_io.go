@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"../go"
+)
+
+// Checks Stream as an io.Reader/io.Writer and net.Conn: io.Copy, EOF
+// ordering, blocking reads and the read ahead helpers, over a net.Pipe.
+
+const (
+	STREAMS = 64
+	PAYLOAD = 1024 * 1024
+)
+
+var failed = false
+
+func check(name string, ok bool, args ...interface{}) {
+	if ok {
+		log.Println("PASS", name)
+	} else {
+		log.Println("FAIL", name, fmt.Sprint(args...))
+		failed = true
+	}
+}
+
+func pipe(options ...multiplex.Option) (*multiplex.Multiplex, *multiplex.Multiplex) {
+	a, b := net.Pipe()
+	ma, mb := multiplex.NewMultiplex(a, options...), multiplex.NewMultiplex(b, options...)
+	ma.EnableAll(0)
+	mb.EnableAll(0)
+	return ma, mb
+}
+
+func payload(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func copy_until_eof() {
+	// io.Copy returns nil once the peer closed its side of the channel
+	tx, rx := pipe(multiplex.WithControlFrames())
+	defer tx.Close()
+	defer rx.Close()
+
+	data := payload(PAYLOAD)
+	go func() {
+		sender := multiplex.NewStream(tx, 1)
+		for sent := 0; sent < len(data); sent += 10000 {
+			sender.Write(data[sent:min(sent+10000, len(data))])
+		}
+		sender.CloseWrite()
+	}()
+
+	var received bytes.Buffer
+	stream := multiplex.NewStream(rx, 1)
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, err := io.Copy(&received, stream)
+	check("io.Copy until EOF", err == nil && n == PAYLOAD && bytes.Equal(received.Bytes(), data), err, " copied ", n)
+}
+
+func cpu_time() time.Duration {
+	var usage syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func idle_streams() {
+	// streams blocked in Read wait for a notification: they don't spin
+	tx, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	rx.StartReader()
+
+	var wg sync.WaitGroup
+	errors := make(chan error, STREAMS)
+	for ch := uint(0); ch < STREAMS; ch++ {
+		wg.Add(1)
+		go func(ch uint) {
+			defer wg.Done()
+			stream := multiplex.NewStream(rx, ch)
+			stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+			buffer := make([]byte, 10)
+			n, err := stream.Read(buffer)
+			if err == nil && string(buffer[:n]) != fmt.Sprint(ch) {
+				err = fmt.Errorf("channel %d: %q", ch, buffer[:n])
+			}
+			if err != nil {
+				errors <- err
+			}
+		}(ch)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	start, used := time.Now(), cpu_time()
+	time.Sleep(500 * time.Millisecond)
+	used, elapsed := cpu_time()-used, time.Since(start)
+	check("idle streams", used < elapsed/10, "cpu ", used, " in ", elapsed)
+
+	for ch := uint(0); ch < STREAMS; ch++ {
+		tx.Send(ch, []byte(fmt.Sprint(ch)))
+	}
+	wg.Wait()
+	close(errors)
+
+	err := <-errors
+	check("idle streams, woken up", err == nil, err)
+}
+
+func copy_round_trip() {
+	// an echo server that is just io.Copy, and back
+	tx, rx := pipe(multiplex.WithControlFrames())
+	defer tx.Close()
+	defer rx.Close()
+
+	rx.StartReader()
+	go func() {
+		echo := multiplex.NewStream(rx, 2)
+		echo.SetDeadline(time.Now().Add(10 * time.Second))
+		io.Copy(echo, echo)
+		echo.CloseWrite()
+	}()
+
+	tx.StartReader()
+	stream := multiplex.NewStream(tx, 2)
+	stream.SetDeadline(time.Now().Add(10 * time.Second))
+
+	data := payload(PAYLOAD / 4)
+	go func() {
+		io.Copy(stream, bytes.NewReader(data))
+		stream.CloseWrite()
+	}()
+
+	received, err := io.ReadAll(stream)
+	check("io.Copy round trip", err == nil && bytes.Equal(received, data), err, " received ", len(received))
+}
+
+func read_byte() {
+	// ReadByte, UnreadByte and ReadString interleaved with Read
+	tx, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	go func() {
+		tx.Send(3, []byte("hello\nwor"))
+		tx.Send(3, []byte("ld\nbye"))
+	}()
+
+	stream := multiplex.NewStream(rx, 3)
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+
+	c, err := stream.ReadByte()
+	check("ReadByte", err == nil && c == 'h', err)
+	check("UnreadByte", stream.UnreadByte() == nil)
+	check("UnreadByte twice", stream.UnreadByte() == multiplex.INVALID_ARGUMENT)
+
+	buffer := make([]byte, 3)
+	n, err := stream.Read(buffer)
+	check("Read after UnreadByte", err == nil && string(buffer[:n]) == "hel", err, string(buffer[:n]))
+	check("UnreadByte after Read", stream.UnreadByte() == multiplex.INVALID_ARGUMENT)
+
+	line, err := stream.ReadString('\n')
+	check("ReadString", err == nil && line == "lo\n", err, line)
+
+	line, err = stream.ReadString('\n')
+	check("ReadString across frames", err == nil && line == "world\n", err, line)
+
+	c, _ = stream.ReadByte()
+	n, err = stream.Read(buffer)
+	check("Read after ReadByte", err == nil && c == 'b' && string(buffer[:n]) == "ye", err, string(buffer[:n]))
+}
+
+func data_then_eof() {
+	// the peer writes and closes the connection right away: the data is
+	// read first, then io.EOF
+	tx, rx := pipe()
+	defer rx.Close()
+
+	go func() {
+		tx.Send(4, []byte("last words"))
+		tx.Close()
+	}()
+
+	stream := multiplex.NewStream(rx, 4)
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+
+	// wait for the connection to be gone, with the data buffered
+	for rx.Healthy() {
+		rx.Select(10 * time.Millisecond)
+	}
+
+	buffer := make([]byte, 4)
+	n, err := stream.Read(buffer)
+	check("data before EOF", err == nil && string(buffer[:n]) == "last", err)
+
+	rest, err := io.ReadAll(stream)
+	check("rest of the data before EOF", err == nil && string(rest) == " words", err, string(rest))
+
+	n, err = stream.Read(buffer)
+	check("EOF after the data", n == 0 && err == io.EOF, err)
+}
+
+func open_stream() {
+	// a stream sized for its frames doesn't reallocate, the default one does
+	tx, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	rx.Disable(5)
+	rx.Disable(6)
+	sized, err := rx.OpenStream(5, 16384)
+	check("OpenStream", err == nil, err)
+	rx.Enable(6, 0)
+	small := multiplex.NewStream(rx, 6)
+
+	frame := payload(10000)
+	go func() {
+		for i := 0; i < 20; i++ {
+			tx.Send(5, frame)
+			tx.Send(6, frame)
+		}
+	}()
+
+	buffer := make([]byte, len(frame))
+	for _, stream := range []*multiplex.Stream{sized, small} {
+		stream.SetReadDeadline(time.Now().Add(time.Second))
+	}
+	for i := 0; i < 20; i++ {
+		io.ReadFull(small, buffer)
+		io.ReadFull(sized, buffer)
+	}
+
+	check("OpenStream, no churn", rx.ReallocationRate(5) == 0, rx.ReallocationRate(5))
+	check("default stream, churn", rx.ReallocationRate(6) > 0, rx.ReallocationRate(6))
+
+	free := rx.ChannelFree(6)
+	err = small.Grow(free + 10000)
+	check("Grow", err == nil && rx.ChannelFree(6) >= free+10000, err, rx.ChannelFree(6))
+
+	rx.Disable(7)
+	rx.Enable(7, 0)
+	err = multiplex.NewStream(rx, 7).SetReadBufferInitial(32768)
+	check("SetReadBufferInitial", err == nil && rx.ChannelFree(7) >= 32768, err, rx.ChannelFree(7))
+
+	rx.Disable(7)
+	err = multiplex.NewStream(rx, 7).SetReadBufferInitial(32768)
+	check("SetReadBufferInitial, disabled", err == multiplex.CHANNEL_CLOSED, err)
+}
+
+func set_channel() {
+	// switching channels while another goroutine reads the stream (run
+	// with -race): the reads are non-blocking, so that SetChannel runs
+	// between them rather than while the reader waits
+	tx, rx := pipe()
+	defer tx.Close()
+	defer rx.Close()
+
+	rx.StartReader()
+	rx.SetNonBlocking(8, true)
+	rx.SetNonBlocking(9, true)
+	stream := multiplex.NewStream(rx, 8)
+
+	done := make(chan string, 1)
+	go func() {
+		buffer := make([]byte, 10)
+		for start := time.Now(); time.Since(start) < time.Second; runtime.Gosched() {
+			if n, err := stream.Read(buffer); err == nil {
+				done <- string(buffer[:n])
+				return
+			}
+		}
+		done <- ""
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	err := stream.SetChannel(9)
+	tx.Send(9, []byte("nine"))
+
+	data := <-done
+	check("SetChannel while reading", err == nil && data == "nine" && stream.Channel() == 9, err, data)
+}
+
+func main() {
+	copy_until_eof()
+	idle_streams()
+	copy_round_trip()
+	read_byte()
+	data_then_eof()
+	open_stream()
+	set_channel()
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,219 @@
+package multiplex
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// ----------------------------------------------------------------------
+//
+//   WRITE COALESCING
+//
+// ----------------------------------------------------------------------
+// Under a high rate of small sends each frame costs a write syscall. With
+// write coalescing the frames sent within a short window are queued and
+// then written together, with a single writev when the connection
+// supports it. This is the multiplexer analog of Nagle's algorithm.
+
+// SetWriteCoalesce sets how long sent frames are queued before being
+// written. Zero disables coalescing (the default): frames already queued
+// are written and Send goes back to writing immediately.
+//
+// While coalescing, Send returns as soon as the frame is queued, and write
+// errors are reported by the following Send or Flush. Stream write
+// deadlines only apply to the queueing, not to the actual write.
+func (c *Multiplex) SetWriteCoalesce(window time.Duration) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.coalesce = window
+	if window <= 0 {
+		c.coalesce = 0
+		return c.flush_frames()
+	}
+
+	return nil
+}
+
+// A QueuePolicy tells Send what to do when queueing a frame would exceed
+// the send queue limit.
+type QueuePolicy int
+
+const (
+	QUEUE_BLOCK QueuePolicy = iota // write the queued frames first, blocking on the connection
+	QUEUE_ERROR                    // fail with CHANNEL_QUEUE_FULL
+)
+
+// SetSendQueueLimit caps the total bytes (headers included) of the frames
+// queued by write coalescing, across all channels, so that a slow peer
+// can't make the queue grow without bounds. Zero removes the limit (the
+// default). When a Send would exceed the limit, the policy decides whether
+// it blocks until the queue is written or returns CHANNEL_QUEUE_FULL. A
+// frame larger than the limit is still queued, on its own.
+func (c *Multiplex) SetSendQueueLimit(maxBytes int, policy QueuePolicy) error {
+	if maxBytes < 0 {
+		return INVALID_ARGUMENT
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.queue_limit = maxBytes
+	c.queue_policy = policy
+	return nil
+}
+
+// reserve_queue makes room in the send queue for a frame of length bytes.
+func (c *Multiplex) reserve_queue(length int) error {
+	if c.queue_limit == 0 || c.queued_bytes == 0 || c.queued_bytes+length <= c.queue_limit {
+		return nil
+	}
+
+	if c.queue_policy == QUEUE_ERROR {
+		return CHANNEL_QUEUE_FULL
+	}
+
+	return c.write_queued()
+}
+
+func (c *Multiplex) queue_frame(frame []byte) {
+	c.queued = append(c.queued, frame)
+	c.queued_bytes += len(frame)
+
+	if c.flush_timer == nil {
+		c.flush_timer = time.AfterFunc(c.coalesce, func() {
+			c.Lock()
+			c.flush_timer = nil
+			if err := c.flush_frames(); err != nil {
+				c.write_err = err
+			}
+			c.Unlock()
+		})
+	}
+}
+
+// FlushContext is like Flush, but stops waiting when ctx is done and
+// returns ctx.Err(), so that a stalled peer can't block the caller forever.
+// The queued frames are not dropped: they are still written in the
+// background, and if that fails the error is reported by the following
+// Send or Flush, as for a coalesced write.
+func (c *Multiplex) FlushContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	abandoned := false
+
+	go func() {
+		c.Lock()
+		defer c.Unlock()
+
+		err := c.flush_frames()
+		if abandoned && err != nil {
+			c.write_err = err
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	select {
+	case err := <-done:
+		// finished in the meantime
+		return err
+	default:
+	}
+
+	abandoned = true
+	return ctx.Err()
+}
+
+// flush_frames writes the queued frames, if any.
+func (c *Multiplex) flush_frames() error {
+	c.begin_write()
+	defer c.end_write()
+
+	return c.write_queued()
+}
+
+// write_queued is flush_frames, with the connection already reserved (see
+// begin_write).
+func (c *Multiplex) write_queued() error {
+	if c.flush_timer != nil {
+		c.flush_timer.Stop()
+		c.flush_timer = nil
+	}
+
+	if len(c.queued) == 0 {
+		return nil
+	}
+
+	length := c.queued_bytes
+	frames := c.queued
+	c.queued = nil
+	c.queued_bytes = 0
+
+	_, err := c.write_buffers(frames, length)
+	return err
+}
+
+// write_buffers writes length bytes from buffers, with a single writev when
+// the connection supports it.
+func (c *Multiplex) write_buffers(buffers net.Buffers, length int) (int, error) {
+	if c.codec != nil {
+		// each buffer is a whole frame (see queue_frame)
+		written := 0
+		for _, frame := range buffers {
+			n, err := c.write_frame(frame)
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+
+		return length, nil
+	}
+
+	var written int64
+	var err error
+
+	if c.send_tap != nil {
+		// WriteTo consumes buffers
+		tapped := append([][]byte(nil), buffers...)
+		defer func() { c.tap_sent(tapped, int(written)) }()
+	}
+
+	conn := c.conn
+	c.write_started()
+	c.write_unlocked(func() {
+		written, err = buffers.WriteTo(conn)
+	})
+	for retries := 0; err != nil && c.retry_write(retries, err); retries++ {
+		// WriteTo consumed what was written, write the rest
+		var n int64
+		c.write_unlocked(func() {
+			n, err = buffers.WriteTo(conn)
+		})
+		written += n
+	}
+	c.write_done()
+
+	if err == nil && int(written) < length {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return int(written), c.write_failed(conn, int(written), err)
+	}
+
+	return length, nil
+}
@@ -0,0 +1,160 @@
+package multiplex
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// ----------------------------------------------------------------------
+//
+//   CODECS
+//
+// ----------------------------------------------------------------------
+// Over a transport that already delivers discrete messages (a WebSocket,
+// an SSH channel, datagrams) the length in the frame header is redundant.
+// A Codec replaces the built-in header: the multiplexer hands it whole
+// frames to write and takes whole frames from it, and the codec decides
+// how the channel ID and the frame boundaries go on the wire.
+//
+// Without a codec the frames use the built-in header (see HEADER), that
+// is the 5 byte [len:4][channel] format unless WithVersion or
+// WithMagicHeader change it.
+
+const (
+	CODEC_CONTROL = 0x100 // set in the channel ID of control frames passed to a Codec
+)
+
+// A Codec reads and writes single frames. The channel ID of a control frame
+// (see WithControlFrames) has CODEC_CONTROL set, and the codec must return
+// it as is. The payload includes the sequence number, if enabled.
+//
+// The multiplexer calls WriteFrame and ReadFrame without holding its lock,
+// but never concurrently with itself: one WriteFrame and one ReadFrame can
+// run at the same time. The payload passed to WriteFrame is only valid
+// during the call, and the one returned by ReadFrame only until the next
+// call. Read timeouts are still applied with SetReadDeadline on the
+// connection passed to NewMultiplex, so the codec must read from (or
+// through) it, and return an error with Timeout() when the deadline
+// expires. io.EOF means the connection was closed.
+type Codec interface {
+	WriteFrame(channelId uint, payload []byte) error
+	ReadFrame() (uint, []byte, error)
+}
+
+// WithCodec makes the multiplexer read and write frames with codec instead
+// of the built-in header. The header options (WithVersion, WithMagicHeader,
+// WithReadBuffer) don't apply then. Both ends must use the same codec. The
+// codec is kept by ReplaceConn, so it must follow the new connection.
+func WithCodec(codec Codec) Option {
+	return func(c *Multiplex) {
+		c.codec = codec
+	}
+}
+
+// read_codec reads the next frame with the codec, as read_frame does. The
+// frame data belongs to the codec, so there is no scratch buffer.
+func (c *Multiplex) read_codec(conn net.Conn, timeout time.Duration) (uint, bool, []byte, *[]byte, error) {
+	if timeout != time.Duration(0) {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		conn.SetReadDeadline(NO_DEADLINE)
+	}
+
+	channelId, payload, err := c.codec.ReadFrame()
+	if err != nil {
+		return 0, false, nil, nil, conn_error(err)
+	}
+
+	control := channelId&CODEC_CONTROL != 0
+	channelId &^= CODEC_CONTROL
+
+	if control && !c.control {
+		log.Println("read_codec", "unexpected control frame")
+		return 0, false, nil, nil, CHANNEL_PROTOCOL
+	}
+	if channelId >= c.max_channels {
+		log.Println("read_codec", "invalid channel", channelId)
+		return 0, false, nil, nil, CHANNEL_PROTOCOL
+	}
+
+	return channelId, control, payload, nil, nil
+}
+
+// write_codec writes a frame built by frame_prefix with the codec, that
+// gets the channel from the header and the payload after it.
+func (c *Multiplex) write_codec(frame []byte) (int, error) {
+	hl := c.header_length()
+	_, channelId, control, err := c.decode_header(frame[:hl])
+	if err != nil {
+		return 0, err
+	}
+	if control {
+		channelId |= CODEC_CONTROL
+	}
+
+	conn := c.conn
+	c.write_unlocked(func() {
+		err = c.codec.WriteFrame(channelId, frame[hl:])
+	})
+	if err == CHANNEL_FRAME_TOO_LARGE {
+		return 0, err
+	}
+	if err != nil {
+		// the codec writes frames as a whole, nothing was sent
+		return 0, c.write_failed(conn, 0, err)
+	}
+
+	return len(frame), nil
+}
+
+// PacketCodec is a reference Codec for a net.PacketConn, that sends each
+// frame as a datagram with a 2 byte header, the channel ID (and
+// CODEC_CONTROL) in big endian:
+//
+//	[channel:2][payload]
+//
+// As for NewMultiplexPacket, if the PacketConn is not connected frames are
+// sent to the peer of the last received datagram. Use it as:
+//
+//	c := NewMultiplexPacket(pc, WithCodec(NewPacketCodec(pc)))
+type PacketCodec struct {
+	conn packetConn
+	rbuf []byte // last received datagram, reused
+	wbuf []byte // datagram being sent, reused
+}
+
+func NewPacketCodec(pc net.PacketConn) *PacketCodec {
+	return &PacketCodec{conn: packetConn{PacketConn: pc}}
+}
+
+func (p *PacketCodec) WriteFrame(channelId uint, payload []byte) error {
+	if len(payload)+2 > MAX_DATAGRAM_SIZE {
+		return CHANNEL_FRAME_TOO_LARGE
+	}
+
+	p.wbuf = append(p.wbuf[:0], byte(channelId>>8), byte(channelId))
+	p.wbuf = append(p.wbuf, payload...)
+
+	_, err := p.conn.Write(p.wbuf)
+	return err
+}
+
+func (p *PacketCodec) ReadFrame() (uint, []byte, error) {
+	if p.rbuf == nil {
+		p.rbuf = make([]byte, MAX_DATAGRAM_SIZE)
+	}
+
+	for {
+		n, err := p.conn.Read(p.rbuf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < 2 {
+			log.Println("PacketCodec", "short datagram", n)
+			continue
+		}
+
+		return uint(p.rbuf[0])<<8 | uint(p.rbuf[1]), p.rbuf[2:n], nil
+	}
+}
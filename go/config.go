@@ -0,0 +1,82 @@
+package multiplex
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * Config holds the settings of a Multiplex, so that a server can create one
+ * per accepted connection without repeating the options and setters:
+ *
+ *   cfg := multiplex.Config{InitialBufferSize: 4096, LoopInterval: time.Second}
+ *   for {
+ *       conn, _ := listener.Accept()
+ *       go serve(cfg.New(conn))
+ *   }
+ *
+ * Zero values keep the defaults. A Config is a plain value: fill it once
+ * and share it, New doesn't modify it.
+ */
+type Config struct {
+	MaxChannels           uint          // see NewMultiplexEx (0 = MAX_CHANNELS)
+	InitialBufferSize     int           // see SetInitialBufferSize
+	MaxConcurrentChannels uint          // see SetMaxConcurrentChannels
+	TotalBufferLimit      int           // see SetTotalBufferLimit
+	HoldLimit             int           // see SetHoldLimit
+	LoopInterval          time.Duration // see SetLoopInterval
+	RenotifyInterval      time.Duration // see SetRenotifyInterval
+	FairShare             int           // see SetFairShare
+	WriteCoalesce         time.Duration // see SetWriteCoalesce
+	StartupTimeout        time.Duration // see SetStartupTimeout, counted from New
+	FrameBufferPool       *sync.Pool    // see SetFrameBufferPool
+	Options               []Option      // i.e. WithControlFrames, WithVersion
+}
+
+// New creates a Multiplex for conn with the configured settings. It returns
+// nil if MaxChannels is invalid, as NewMultiplexEx does.
+func (cfg Config) New(conn net.Conn) *Multiplex {
+	maxChannels := cfg.MaxChannels
+	if maxChannels == 0 {
+		maxChannels = MAX_CHANNELS
+	}
+
+	c := NewMultiplexEx(conn, maxChannels, cfg.Options...)
+	if c == nil {
+		return nil
+	}
+
+	if cfg.InitialBufferSize > 0 {
+		c.SetInitialBufferSize(cfg.InitialBufferSize)
+	}
+	if cfg.MaxConcurrentChannels > 0 {
+		c.SetMaxConcurrentChannels(cfg.MaxConcurrentChannels)
+	}
+	if cfg.TotalBufferLimit > 0 {
+		c.SetTotalBufferLimit(cfg.TotalBufferLimit)
+	}
+	if cfg.HoldLimit > 0 {
+		c.SetHoldLimit(cfg.HoldLimit)
+	}
+	if cfg.LoopInterval > 0 {
+		c.SetLoopInterval(cfg.LoopInterval)
+	}
+	if cfg.RenotifyInterval > 0 {
+		c.SetRenotifyInterval(cfg.RenotifyInterval)
+	}
+	if cfg.FairShare > 0 {
+		c.SetFairShare(cfg.FairShare)
+	}
+	if cfg.WriteCoalesce > 0 {
+		c.SetWriteCoalesce(cfg.WriteCoalesce)
+	}
+	if cfg.StartupTimeout > 0 {
+		c.SetStartupTimeout(cfg.StartupTimeout)
+	}
+	if cfg.FrameBufferPool != nil {
+		c.SetFrameBufferPool(cfg.FrameBufferPool)
+	}
+
+	return c
+}
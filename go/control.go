@@ -0,0 +1,285 @@
+package multiplex
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// ----------------------------------------------------------------------
+//
+//   CONTROL FRAMES
+//
+// ----------------------------------------------------------------------
+// Control frames carry channel state instead of data. They are marked by
+// the high bit of the length field (no data frame is that large) and the
+// first byte of the payload is the control type:
+//
+//   CONTROL_CLOSE  the sender won't send any more data on the channel,
+//                  optionally followed by [code:2][message] (see CloseError)
+//   CONTROL_NACK   the sender dropped a data frame because the channel is not
+//                  enabled on its side (see WithNack)
+//
+// Control frames are opt-in, since a peer that doesn't know about them
+// (i.e. the C implementation) would take them for huge data frames.
+
+const (
+	CONTROL_FLAG = 1 << 31
+
+	CONTROL_CLOSE = 1
+	CONTROL_NACK  = 2
+)
+
+// Close codes, mirroring the WebSocket ones. Codes from 4000 to 4999 are
+// available to applications.
+const (
+	CLOSE_NORMAL   = 1000
+	CLOSE_PROTOCOL = 1002
+	CLOSE_ERROR    = 1011
+)
+
+// A CloseError is returned by reads on a channel that the peer closed with
+// a code other than CLOSE_NORMAL, once the buffered data is consumed. A
+// normal close returns CHANNEL_EOF instead (io.EOF from Stream and Reader).
+type CloseError struct {
+	Code    int
+	Message string
+}
+
+// Is makes errors.Is(err, CHANNEL_EOF) true for any close by the peer.
+func (e *CloseError) Is(target error) bool {
+	return target == CHANNEL_EOF
+}
+
+func (e *CloseError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("channel closed by peer (%d)", e.Code)
+	}
+
+	return fmt.Sprintf("channel closed by peer (%d): %s", e.Code, e.Message)
+}
+
+// WithControlFrames enables sending and receiving control frames, which
+// both ends must support.
+func WithControlFrames() Option {
+	return func(c *Multiplex) {
+		c.control = true
+	}
+}
+
+// WithNack makes the multiplexer answer a data frame received on a channel
+// that is not enabled (and not held, see SetHoldLimit) with a NACK control
+// frame, instead of just dropping it. On the sending side the next Send on
+// that channel fails with CHANNEL_REJECTED, so that a request sent to a
+// channel nobody listens on is an error instead of a timeout waiting for
+// the response. It needs control frames (see WithControlFrames) on both
+// ends, but only the receiving side needs WithNack. Each dropped frame
+// costs a NACK, except while one for the same channel is being sent.
+func WithNack() Option {
+	return func(c *Multiplex) {
+		c.nack = true
+	}
+}
+
+// send_nack tells the peer a data frame for the channel was dropped. It's
+// sent in the background, since it's called while reading the connection.
+func (c *Multiplex) send_nack(channelId uint) {
+	if !c.nack || !c.control || c.nacking[channelId] {
+		return
+	}
+
+	c.nacking[channelId] = true
+	go func() {
+		c.Lock()
+		defer c.Unlock()
+
+		if err := c.send_control(channelId, []byte{CONTROL_NACK}); err != nil {
+			log.Println("send_nack", channelId, err)
+		}
+		c.nacking[channelId] = false
+	}()
+}
+
+// receive_nack records that the peer dropped a frame we sent on the
+// channel, that doesn't need to be enabled here (i.e. we only send on it).
+func (c *Multiplex) receive_nack(channelId uint) (uint, error) {
+	log.Println("receive_nack", channelId)
+	c.rejected[channelId] = true
+	return channelId, CHANNEL_IGNORED
+}
+
+// check_rejected returns CHANNEL_REJECTED, once, if the peer dropped a
+// frame sent on the channel since the last check (see WithNack).
+func (c *Multiplex) check_rejected(channelId uint) error {
+	if channelId < MAX_CHANNELS && c.rejected[channelId] {
+		c.rejected[channelId] = false
+		return CHANNEL_REJECTED
+	}
+
+	return nil
+}
+
+// send_control sends a control frame on the channel. As for any frame, the
+// lock is released while it's written (see write_unlocked), so the channel
+// state must be checked again afterwards.
+func (c *Multiplex) send_control(channelId uint, payload []byte) error {
+	if !c.control {
+		return CHANNEL_NO_CONTROL
+	}
+
+	_, err := c.send_frame(channelId, payload, true, NO_DEADLINE)
+	return err
+}
+
+func (c *Multiplex) receive_control(channelId uint, payload []byte) (uint, error) {
+	if len(payload) == 0 {
+		log.Println("receive_control", channelId, "empty control frame")
+		return channelId, CHANNEL_PROTOCOL
+	}
+
+	switch payload[0] {
+	case CONTROL_CLOSE:
+		buf := c.channels[channelId]
+		if buf.draining {
+			// already closed locally
+			break
+		}
+
+		buf.eof = true
+
+		if len(payload) >= 3 {
+			code := int(payload[1])<<8 | int(payload[2])
+			if code != CLOSE_NORMAL {
+				buf.close_err = &CloseError{code, string(payload[3:])}
+			}
+		}
+
+	default:
+		log.Println("receive_control", channelId, "unknown control frame", payload[0])
+		c.count_ignored()
+		return channelId, CHANNEL_IGNORED
+	}
+
+	return channelId, nil
+}
+
+// CloseWrite tells the peer that no more data will be sent on the channel:
+// once the data already sent is consumed, reads on that channel return
+// CHANNEL_EOF (io.EOF from Stream and Reader). The channel can still
+// receive data.
+func (c *Multiplex) CloseWrite(channelId uint) error {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.send_control(channelId, close_payload(CLOSE_NORMAL, ""))
+}
+
+// CloseChannel tells the peer the channel is closed, with the given code and
+// message (see CloseError), and disables the channel. If control frames are
+// not enabled the channel is just disabled.
+func (c *Multiplex) CloseChannel(channelId uint, code int, message string) error {
+	if !c.lock_channel(channelId) {
+		return CHANNEL_CLOSED
+	}
+
+	defer c.Unlock()
+
+	var err error
+	if c.control {
+		// the lock is released while the frame is written (see
+		// write_unlocked): the channel may be disabled, and enabled again,
+		// in the meantime
+		buf := c.channels[channelId]
+		err = c.send_control(channelId, close_payload(code, message))
+		if c.channels[channelId] != buf {
+			return err
+		}
+	}
+
+	c.disable_channel(channelId)
+	return err
+}
+
+// CloseChannelAfterDrain is like CloseChannel, but the data already
+// buffered for the channel can still be read.
+//
+// The peer is told the channel is closed right away, as with CloseChannel.
+// Locally the channel stops accepting data (frames received afterwards are
+// dropped, including a close from the peer) and reads return the buffered
+// data, then CHANNEL_EOF: the read that returns it disables the channel, and
+// the following reads return CHANNEL_CLOSED, as after CloseChannel.
+func (c *Multiplex) CloseChannelAfterDrain(channelId uint, code int, message string) error {
+	if !c.lock_channel(channelId) {
+		return CHANNEL_CLOSED
+	}
+
+	defer c.Unlock()
+
+	// before sending, since the lock is released while the frame is written
+	// (see write_unlocked) and the channel may be disabled in the meantime
+	buf := c.channels[channelId]
+	buf.draining = true
+	buf.eof = true
+	buf.close_err = nil
+	c.cond.Broadcast()
+
+	if c.control {
+		return c.send_control(channelId, close_payload(code, message))
+	}
+
+	return nil
+}
+
+// channel_eof returns buf.eof_error for the channel, and disables it if it
+// was closed with CloseChannelAfterDrain.
+func (c *Multiplex) channel_eof(channelId uint) error {
+	buf := c.channels[channelId]
+	err := buf.eof_error()
+	if buf.draining {
+		c.disable_channel(channelId)
+	}
+
+	return err
+}
+
+func close_payload(code int, message string) []byte {
+	return append([]byte{CONTROL_CLOSE, byte(code >> 8), byte(code)}, message...)
+}
+
+// eof_error is what reads return once the peer closed the channel and the
+// buffered data has been consumed. Unlike CHANNEL_CLOSED, that is returned
+// once the connection is gone, it only concerns this channel.
+func (buf *ChannelBuffer) eof_error() error {
+	if buf.close_err != nil {
+		return buf.close_err
+	}
+
+	return CHANNEL_EOF
+}
+
+// ReceiveTo receives data from the channel and writes it to w, until the
+// peer closes its side of the channel (see CloseWrite) or an error occurs.
+// It returns the number of bytes written, and a nil error on a clean close.
+// The timeout applies to each wait for data, as in Receive.
+func (c *Multiplex) ReceiveTo(timeout time.Duration, channelId uint, w io.Writer) (int64, error) {
+	buffer := make([]byte, 32*1024)
+	total := int64(0)
+
+	for {
+		n, err := c.Receive(timeout, channelId, buffer)
+		if n > 0 {
+			written, werr := w.Write(buffer[:n])
+			total += int64(written)
+			if werr != nil {
+				return total, werr
+			}
+		}
+
+		if err == CHANNEL_EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
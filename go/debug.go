@@ -0,0 +1,198 @@
+package multiplex
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------
+//
+//   STATE DUMP
+//
+// ----------------------------------------------------------------------
+// String and DumpState describe the connection and its channels for
+// debugging. They never print buffered data, only sizes and flags, so the
+// output is bounded (a line per enabled channel) and safe to log. String
+// doesn't take the lock, and DumpState doesn't wait for it more than
+// DUMP_LOCK_TIMEOUT: a connection wedged while holding the lock can still
+// be inspected.
+
+var (
+	DUMP_LOCK_TIMEOUT = 100 * time.Millisecond // how long DumpState waits for the lock
+)
+
+// String returns a one line summary of the connection: addresses, totals
+// and health. It doesn't take the lock.
+func (c *Multiplex) String() string {
+	local, remote := "?", "?"
+	if conn, ok := c.current.Load().(net.Conn); ok && conn != nil {
+		local, remote = addr_string(conn.LocalAddr()), addr_string(conn.RemoteAddr())
+	}
+
+	stats := c.TotalStats()
+	health := "healthy"
+	if !c.Healthy() {
+		health = "unhealthy"
+	}
+
+	return fmt.Sprintf("multiplex %s->%s sent %d frames/%d bytes, received %d frames/%d bytes, %s",
+		local, remote, stats.FramesSent, stats.BytesSent, stats.FramesReceived, stats.BytesReceived, health)
+}
+
+func addr_string(addr net.Addr) string {
+	if addr == nil {
+		return "?"
+	}
+
+	return addr.String()
+}
+
+// channelState is the part of a ChannelBuffer that DumpState prints.
+type channelState struct {
+	id                           uint
+	length, capacity, offset     int
+	newData, frames, initial     int
+	idle                         time.Duration
+	flags                        []string
+	priority, held, tees, queued int
+	stats                        Stats
+}
+
+// DumpState returns a multi-line description of the connection (see
+// String) and of the state of each enabled channel: buffered length,
+// capacity, offset, data not selected yet, frames, idle time, flags and
+// frame totals (see ChannelStats), followed by the non-zero error counts.
+// If the lock can't be taken within DUMP_LOCK_TIMEOUT only the connection
+// summary is returned, noting that the lock is busy, which is itself a hint
+// of where it's wedged.
+func (c *Multiplex) DumpState() string {
+	var b strings.Builder
+	b.WriteString(c.String())
+	b.WriteString("\n")
+
+	if !c.lock_within(DUMP_LOCK_TIMEOUT) {
+		fmt.Fprintf(&b, "  lock busy for more than %v, no channel state\n", DUMP_LOCK_TIMEOUT)
+		return b.String()
+	}
+
+	now := time.Now()
+	conn := []string{}
+	if c.closed {
+		conn = append(conn, "closed")
+	}
+	if c.peer_closed {
+		conn = append(conn, "peer_closed")
+	}
+	if c.desync {
+		conn = append(conn, "desync")
+	}
+	if c.reader {
+		conn = append(conn, "reader")
+	}
+	if c.reading {
+		conn = append(conn, "reading")
+	}
+	if c.writing {
+		conn = append(conn, "writing")
+	}
+	summary := fmt.Sprintf("  channels %d/%d, buffers %d bytes (limit %d), queued %d frames/%d bytes, waiters %d, read error %v, flags [%s]",
+		c.active, c.max_channels, c.buffer_total, c.buffer_limit, len(c.queued), c.queued_bytes, len(c.waiters), c.read_err, strings.Join(conn, " "))
+
+	channels := make([]channelState, 0, c.active)
+	for i := uint(0); i < c.max_channels; i++ {
+		buf := c.channels[i]
+		if buf == nil {
+			continue
+		}
+
+		state := channelState{
+			id:       i,
+			length:   buf.length,
+			capacity: len(buf.data),
+			offset:   buf.offset,
+			newData:  buf.newData,
+			frames:   len(buf.frames),
+			initial:  buf.initial,
+			idle:     now.Sub(buf.lastActivity).Truncate(time.Millisecond),
+			priority: buf.priority,
+			held:     buf.held,
+			tees:     len(c.tees[i]),
+			stats:    buf.stats,
+		}
+		if sink := c.sinks[i]; sink != nil {
+			state.flags = append(state.flags, "sink")
+			state.queued = len(sink.queue)
+		}
+		for _, flag := range []struct {
+			on   bool
+			name string
+		}{
+			{buf.paused, "paused"},
+			{buf.eof, "eof"},
+			{buf.draining, "draining"},
+			{buf.nonblocking, "nonblocking"},
+			{buf.sensitive, "sensitive"},
+			{buf.positional, "positional"},
+			{buf.signaled, "signaled"},
+		} {
+			if flag.on {
+				state.flags = append(state.flags, flag.name)
+			}
+		}
+
+		channels = append(channels, state)
+	}
+	c.Unlock()
+
+	b.WriteString(summary)
+	b.WriteString("\n")
+
+	for _, s := range channels {
+		fmt.Fprintf(&b, "  channel %3d: length %d capacity %d (initial %d) offset %d new %d frames %d idle %v priority %d, sent %d frames/%d bytes, received %d frames/%d bytes",
+			s.id, s.length, s.capacity, s.initial, s.offset, s.newData, s.frames, s.idle, s.priority,
+			s.stats.FramesSent, s.stats.BytesSent, s.stats.FramesReceived, s.stats.BytesReceived)
+		if s.held > 0 {
+			fmt.Fprintf(&b, " held %d", s.held)
+		}
+		if s.tees > 0 {
+			fmt.Fprintf(&b, " tees %d", s.tees)
+		}
+		if s.queued > 0 {
+			fmt.Fprintf(&b, " sink queue %d", s.queued)
+		}
+		if len(s.flags) > 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(s.flags, " "))
+		}
+		b.WriteString("\n")
+	}
+
+	errors := []string{}
+	for name, count := range c.ErrorCounts() {
+		if count > 0 {
+			errors = append(errors, fmt.Sprintf("%s=%d", name, count))
+		}
+	}
+	if len(errors) > 0 {
+		sort.Strings(errors)
+		fmt.Fprintf(&b, "  errors %s\n", strings.Join(errors, " "))
+	}
+
+	return b.String()
+}
+
+// lock_within takes the lock, giving up after timeout.
+func (c *Multiplex) lock_within(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !c.TryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	return true
+}
@@ -0,0 +1,203 @@
+// Package faultconn wraps a net.Conn to inject the transport faults that
+// are hard to get from a real socket on demand: short reads and writes,
+// errors, delays, corrupted bytes and lost writes. It is meant for testing the
+// multiplexer (see example/test_fault.go), not for production use.
+package faultconn
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// A FaultConn is a net.Conn that passes reads and writes to the wrapped
+// connection, altered by the faults set up with its methods. Faults set for
+// the "next" read or write apply once, the chunk sizes until changed.
+type FaultConn struct {
+	net.Conn
+
+	mu          sync.Mutex
+	read_chunk  int           // largest Read (0 = no limit)
+	write_chunk int           // largest Write, that returns a short count with no error (0 = no limit)
+	read_err    error         // returned by the next Read
+	read_after  int           // bytes read before read_err is returned
+	write_err   error         // returned by the next Write
+	write_after int           // bytes written before write_err is returned
+	corrupt     bool          // flip the next byte read
+	write_delay time.Duration // delay before the next Write
+	drop        bool          // discard the next Write
+	reads       int           // Read calls
+	writes      int           // Write calls
+}
+
+func New(conn net.Conn) *FaultConn {
+	return &FaultConn{Conn: conn}
+}
+
+// SetReadChunkSize makes each Read return at most n bytes, so that frames
+// are received in pieces. Zero removes the limit.
+func (f *FaultConn) SetReadChunkSize(n int) {
+	f.mu.Lock()
+	f.read_chunk = n
+	f.mu.Unlock()
+}
+
+// SetWriteChunkSize makes each Write write at most n bytes and return the
+// short count without an error, as a misbehaving writer would. Zero
+// removes the limit.
+func (f *FaultConn) SetWriteChunkSize(n int) {
+	f.mu.Lock()
+	f.write_chunk = n
+	f.mu.Unlock()
+}
+
+// InjectReadError makes the next Read return err, without reading.
+func (f *FaultConn) InjectReadError(err error) {
+	f.FailReadAfter(0, err)
+}
+
+// FailReadAfter makes the reads fail with err once n more bytes have been
+// read: the Read that reaches n returns its bytes with err, i.e. to cut a
+// frame header in half with a timeout.
+func (f *FaultConn) FailReadAfter(n int, err error) {
+	f.mu.Lock()
+	f.read_err = err
+	f.read_after = n
+	f.mu.Unlock()
+}
+
+// InjectWriteError makes the next Write return err, without writing.
+func (f *FaultConn) InjectWriteError(err error) {
+	f.FailWriteAfter(0, err)
+}
+
+// FailWriteAfter makes the writes fail with err once n more bytes have
+// been written: the Write that crosses n writes its first bytes and returns
+// the partial count with err.
+func (f *FaultConn) FailWriteAfter(n int, err error) {
+	f.mu.Lock()
+	f.write_err = err
+	f.write_after = n
+	f.mu.Unlock()
+}
+
+// CorruptNextByte flips the bits of the next byte read.
+func (f *FaultConn) CorruptNextByte() {
+	f.mu.Lock()
+	f.corrupt = true
+	f.mu.Unlock()
+}
+
+// DelayNextWrite makes the next Write wait d before writing.
+func (f *FaultConn) DelayNextWrite(d time.Duration) {
+	f.mu.Lock()
+	f.write_delay = d
+	f.mu.Unlock()
+}
+
+// DropNextWrite makes the next Write report success without writing
+// anything, as a lossy transport losing a frame (the multiplexer writes
+// each frame with a single Write).
+func (f *FaultConn) DropNextWrite() {
+	f.mu.Lock()
+	f.drop = true
+	f.mu.Unlock()
+}
+
+// Counts returns the number of Read and Write calls so far.
+func (f *FaultConn) Counts() (reads int, writes int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.reads, f.writes
+}
+
+func (f *FaultConn) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	f.reads++
+	if f.read_chunk > 0 && len(b) > f.read_chunk {
+		b = b[:f.read_chunk]
+	}
+
+	var fail error
+	if f.read_err != nil && f.read_after < len(b) {
+		// fails in this read, after the first read_after bytes
+		fail = f.read_err
+		b = b[:f.read_after]
+		f.read_err = nil
+	}
+	f.mu.Unlock()
+
+	n := 0
+	var err error
+	if len(b) > 0 {
+		n, err = f.Conn.Read(b)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.read_err != nil {
+		f.read_after -= n
+	}
+	if fail != nil && err == nil {
+		if n == len(b) {
+			err = fail
+		} else {
+			// fewer bytes than the limit, fail later
+			f.read_err = fail
+			f.read_after = len(b) - n
+		}
+	}
+	if f.corrupt && n > 0 {
+		f.corrupt = false
+		b[0] ^= 0xFF
+	}
+
+	return n, err
+}
+
+func (f *FaultConn) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	f.writes++
+	delay := f.write_delay
+	f.write_delay = 0
+
+	if f.drop {
+		f.drop = false
+		f.mu.Unlock()
+		return len(b), nil
+	}
+
+	if f.write_chunk > 0 && len(b) > f.write_chunk {
+		b = b[:f.write_chunk]
+	}
+
+	var fail error
+	if f.write_err != nil {
+		if f.write_after < len(b) {
+			// fails in this write, after the first write_after bytes
+			fail = f.write_err
+			b = b[:f.write_after]
+			f.write_err = nil
+		} else {
+			f.write_after -= len(b)
+		}
+	}
+	f.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	n := 0
+	var err error
+	if len(b) > 0 {
+		n, err = f.Conn.Write(b)
+	}
+	if err == nil {
+		err = fail
+	}
+
+	return n, err
+}
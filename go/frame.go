@@ -0,0 +1,204 @@
+package multiplex
+
+import (
+	"time"
+)
+
+// ----------------------------------------------------------------------
+//
+//   FRAMES
+//
+// ----------------------------------------------------------------------
+// Read and Receive copy as much buffered data as fits in dst, merging
+// consecutive frames. For message oriented consumers we also keep the
+// length of each buffered frame, so that ReadFrame can return exactly one
+// frame at a time.
+
+func (buf *ChannelBuffer) consume_frames(length int) {
+	for length > 0 && len(buf.frames) > 0 {
+		if buf.frames[0] > length {
+			buf.frames[0] -= length
+			return
+		}
+
+		length -= buf.frames[0]
+		buf.frames = buf.frames[1:]
+	}
+}
+
+// next_frame consumes and returns the next buffered frame, or nil.
+func (c *Multiplex) next_frame(channelId uint) []byte {
+	buf := c.channels[channelId]
+	if buf == nil || len(buf.frames) == 0 {
+		return nil
+	}
+
+	frame := make([]byte, buf.frames[0])
+	c.read_channel(channelId, frame)
+	return frame
+}
+
+// ReadFrame returns the bytes of the next frame received on the given
+// channel, waiting up to timeout for one to arrive. If part of a frame was
+// already consumed by Read or Receive, only the remainder is returned.
+// Empty frames are not buffered, so they are never returned. Once the peer
+// closed the channel and all frames were read, it returns CHANNEL_EOF or the
+// peer's *CloseError.
+func (c *Multiplex) ReadFrame(timeout time.Duration, channelId uint) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		if !c.lock_channel(channelId) {
+			return nil, c.count_error(CHANNEL_CLOSED)
+		}
+
+		buf := c.channels[channelId]
+		if !buf.paused {
+			if frame := c.next_frame(channelId); frame != nil {
+				c.Unlock()
+				return frame, nil
+			}
+
+			if buf.eof {
+				// under the lock, it may disable the channel
+				err := c.channel_eof(channelId)
+				c.Unlock()
+				return nil, c.count_error(err)
+			}
+		}
+
+		if buf.nonblocking && !c.closed {
+			c.Unlock()
+			return nil, c.count_error(buf.would_block())
+		}
+
+		err := c.receive_next(timeout, channelId)
+		c.Unlock()
+
+		if err != nil && err != CHANNEL_IGNORED {
+			return nil, c.count_error(err)
+		}
+
+		if timeout, err = remaining(timeout, deadline); err != nil {
+			return nil, c.count_error(err)
+		}
+	}
+}
+
+// ReadAny returns the next frame received on any enabled channel, with its
+// channel id, waiting up to timeout for one to arrive. The frame is
+// consumed, and the data is a copy the caller owns. Frames already buffered
+// are returned first, taking the channels in turn; then a frame read from
+// the connection for a channel with nothing buffered is handed over as is,
+// without going through the channel buffer. This is meant for a router
+// that forwards frames and doesn't care about channel buffers.
+//
+// Only enabled (and not paused) channels are returned. Frames for disabled
+// channels are handled as by Select: held (see SetHoldLimit) until the
+// channel is enabled, or dropped. Control frames and empty frames are
+// processed but not returned, so a channel closed by the peer is not
+// reported (use Select or the channel's Reader to see it). A frame dropped
+// for its channel (see SetChannelMaxMessage) returns its channel id with
+// CHANNEL_FRAME_TOO_LARGE or CHANNEL_BUFFER_LIMIT.
+func (c *Multiplex) ReadAny(timeout time.Duration) (uint, []byte, error) {
+	if c == nil {
+		return 0, nil, CHANNEL_CLOSED
+	}
+	if c.direction == SEND_ONLY {
+		return 0, nil, CHANNEL_DIRECTION
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	c.Lock()
+	defer c.Unlock()
+
+	for {
+		if channelId, frame := c.buffered_frame(); frame != nil {
+			return channelId, frame, nil
+		}
+
+		channelId, frame, err := c.read_any(timeout)
+		if frame != nil {
+			return channelId, frame, nil
+		}
+		if err != nil && err != CHANNEL_IGNORED {
+			return channelId, nil, c.count_error(err)
+		}
+
+		if timeout, err = remaining(timeout, deadline); err != nil {
+			return 0, nil, c.count_error(err)
+		}
+	}
+}
+
+// buffered_frame consumes the next buffered frame, taking the channels in
+// turn, or returns nil.
+func (c *Multiplex) buffered_frame() (uint, []byte) {
+	for n := uint(0); n < c.max_channels; n++ {
+		i := (c.select_next + n) % c.max_channels
+		if buf := c.channels[i]; buf != nil && !buf.paused && len(buf.frames) > 0 {
+			c.select_next = i + 1
+			return i, c.next_frame(i)
+		}
+	}
+
+	return 0, nil
+}
+
+// read_any reads the next frame as read_unlocked does, but if it's for a
+// channel without buffered data it returns the frame instead of buffering
+// it (see write_channel). While someone else is reading the connection it
+// waits for a frame to be buffered, and returns no frame.
+func (c *Multiplex) read_any(timeout time.Duration) (uint, []byte, error) {
+	if c.closed {
+		return 0, nil, CHANNEL_CLOSED
+	}
+	if err := c.read_err; err != nil && !c.reader {
+		return 0, nil, err
+	}
+
+	w := c.add_waiter("ReadAny", c.max_channels)
+	defer c.remove_waiter(w)
+
+	if c.reader || c.reading {
+		_, err := c.wait_channel(timeout, c.max_channels, w)
+		return 0, nil, err
+	}
+
+	channelId, err := c.read_unlocked(timeout, w)
+	frame := w.frame
+	if frame != nil {
+		channelId = w.frame_id
+		if buf := c.channels[channelId]; buf != nil {
+			// taken right away, nothing to select
+			buf.signaled = false
+		}
+	}
+
+	if w.cancelled && frame == nil {
+		return 0, nil, CHANNEL_CANCELLED
+	}
+	return channelId, frame, err
+}
+
+// SetChannelMaxMessage sets the largest frame, in bytes, accepted on the
+// given channel, independent of its buffer size: a larger frame is dropped
+// instead of buffered, and whoever read it from the connection (Select, or
+// Receive on that channel) gets CHANNEL_FRAME_TOO_LARGE. To treat it as a
+// protocol error, close the channel then. The limit is dropped when the
+// channel is disabled. It returns CHANNEL_CLOSED if the channel is not
+// enabled.
+func (c *Multiplex) SetChannelMaxMessage(channelId uint, n int) error {
+	if n <= 0 || channelId >= c.max_channels {
+		return INVALID_ARGUMENT
+	}
+
+	if !c.lock_channel(channelId) {
+		return CHANNEL_CLOSED
+	}
+
+	c.channels[channelId].max_message = n
+	c.Unlock()
+	return nil
+}
@@ -0,0 +1,211 @@
+package multiplex
+
+import (
+	"bufio"
+	"io"
+	"log"
+)
+
+// ----------------------------------------------------------------------
+//
+//   HEADER
+//
+// ----------------------------------------------------------------------
+// The legacy header is 4 bytes of length (including the channel byte)
+// followed by the channel ID:
+//
+//   [len:4][channel]
+//
+// With a protocol version set (see WithVersion) the header is prefixed by
+// a magic byte and the version, so that future header changes can be
+// detected instead of guessed:
+//
+//   [magic][version][len:4][channel]
+//
+// For peers that expect it, the header can also be prefixed by the magic
+// byte only (see WithMagicHeader), which detects a misaligned stream but
+// doesn't carry a version:
+//
+//   [magic][len:4][channel]
+//
+// With control frames enabled (see WithControlFrames) the high bit of the
+// length marks a control frame for the channel.
+//
+// Both ends must agree on the header format. When they don't, i.e. during
+// a rolling upgrade, WithResync lets the end with the magic byte skip what
+// it can't parse instead of failing.
+
+const (
+	PROTOCOL_VERSION = 1 // current protocol version
+
+	magicHeaderLength   = 6 // 1:magic + 4:size + 1:channel
+	versionHeaderLength = 7 // 1:magic + 1:version + 4:size + 1:channel
+)
+
+// RESYNC_MAX_FRAME is the largest frame length that a header is taken to
+// be valid with, when resyncing (see WithResync).
+var RESYNC_MAX_FRAME = 16 * 1024 * 1024
+
+// WithVersion enables the versioned header, sending the given protocol
+// version and rejecting frames with any other version (CHANNEL_VERSION).
+func WithVersion(version byte) Option {
+	return func(c *Multiplex) {
+		c.version = version
+	}
+}
+
+// WithMagicHeader enables the 6 byte header, with the magic byte and no
+// version. Frames that don't start with the magic byte are rejected
+// (CHANNEL_PROTOCOL). WithVersion takes precedence, since the versioned
+// header already starts with the magic byte.
+func WithMagicHeader() Option {
+	return func(c *Multiplex) {
+		c.magic_header = true
+	}
+}
+
+// WithResync makes an invalid header recoverable: instead of failing with
+// CHANNEL_PROTOCOL, the receiver scans up to maxScan bytes forward for the
+// magic byte of a valid header, and the read returns CHANNEL_RESYNC, with
+// the bytes skipped lost. The next read resumes from the header found. If
+// there is none within maxScan bytes, the read fails with CHANNEL_PROTOCOL
+// as before.
+//
+// With resync enabled, a header with a length above RESYNC_MAX_FRAME is
+// also invalid. Resyncing relies on the magic byte, so it needs
+// WithMagicHeader or WithVersion: without them the option has no effect.
+// A frame that happens to contain something that looks like a header may
+// still be taken for one.
+func WithResync(maxScan int) Option {
+	return func(c *Multiplex) {
+		c.resync = maxScan
+	}
+}
+
+func (c *Multiplex) header_length() int {
+	if c.version != 0 {
+		return versionHeaderLength
+	}
+	if c.magic_header {
+		return magicHeaderLength
+	}
+
+	return headerLength
+}
+
+func (c *Multiplex) encode_header(header []byte, channelId uint, length int, control bool) {
+	if c.version != 0 {
+		header[0] = magic
+		header[1] = c.version
+		header = header[2:]
+	} else if c.magic_header {
+		header[0] = magic
+		header = header[1:]
+	}
+
+	if control {
+		length |= CONTROL_FLAG
+	}
+
+	header[0] = (byte)((length >> 24) & 0xFF)
+	header[1] = (byte)((length >> 16) & 0xFF)
+	header[2] = (byte)((length >> 8) & 0xFF)
+	header[3] = (byte)((length >> 0) & 0xFF)
+	header[4] = (byte)(channelId & 0xFF)
+}
+
+func (c *Multiplex) decode_header(header []byte) (int, uint, bool, error) {
+	if c.version != 0 {
+		if header[0] != magic {
+			log.Println("decode_header", "expected", magic, "got", header[0])
+			return 0, 0, false, CHANNEL_PROTOCOL
+		}
+		if header[1] != c.version {
+			log.Println("decode_header", "expected version", c.version, "got", header[1])
+			return 0, 0, false, CHANNEL_VERSION
+		}
+
+		header = header[2:]
+	} else if c.magic_header {
+		if header[0] != magic {
+			log.Println("decode_header", "expected", magic, "got", header[0])
+			return 0, 0, false, CHANNEL_PROTOCOL
+		}
+
+		header = header[1:]
+	}
+
+	dataLength := int(header[0])<<24 | int(header[1])<<16 | int(header[2])<<8 | int(header[3])<<0
+	channelId := uint(header[4])
+
+	control := dataLength&CONTROL_FLAG != 0
+	if control {
+		if !c.control {
+			log.Println("decode_header", "unexpected control frame")
+			return 0, 0, false, CHANNEL_PROTOCOL
+		}
+
+		dataLength &^= CONTROL_FLAG
+	}
+
+	if dataLength < 1 || (c.can_resync() && dataLength > RESYNC_MAX_FRAME) {
+		log.Println("decode_header", "invalid frame length", dataLength)
+		return 0, 0, false, CHANNEL_PROTOCOL
+	}
+
+	return dataLength, channelId, control, nil
+}
+
+func (c *Multiplex) can_resync() bool {
+	return c.resync > 0 && (c.version != 0 || c.magic_header)
+}
+
+// resync_stream looks for a valid header in r after the invalid one in
+// header, a byte at a time. The header found is kept for the next
+// parse_frame from r.
+func (c *Multiplex) resync_stream(r io.Reader, header []byte) error {
+	for skipped := 1; skipped <= c.resync; skipped++ {
+		copy(header, header[1:])
+		if _, err := conn_read(r, 0, header[len(header)-1:]); err != nil {
+			return err
+		}
+
+		if header[0] != magic {
+			continue
+		}
+		if _, _, _, err := c.decode_header(header); err == nil {
+			log.Println("resync", "skipped", skipped)
+			c.resync_hdr = append([]byte(nil), header...)
+			c.resync_from = r
+			return CHANNEL_RESYNC
+		}
+	}
+
+	log.Println("resync", "no valid header in", c.resync)
+	return CHANNEL_PROTOCOL
+}
+
+// resync_buffered is resync_stream for the read buffer, where the header
+// found is left unread.
+func (c *Multiplex) resync_buffered(rd *bufio.Reader) error {
+	hl := c.header_length()
+	for skipped := 1; skipped <= c.resync; skipped++ {
+		rd.Discard(1)
+		header, err := rd.Peek(hl)
+		if err != nil {
+			return conn_error(err)
+		}
+
+		if header[0] != magic {
+			continue
+		}
+		if _, _, _, err := c.decode_header(header); err == nil {
+			log.Println("resync", "skipped", skipped)
+			return CHANNEL_RESYNC
+		}
+	}
+
+	log.Println("resync", "no valid header in", c.resync)
+	rd.Discard(hl)
+	return CHANNEL_PROTOCOL
+}
@@ -0,0 +1,140 @@
+package multiplex
+
+import (
+	"log"
+	"time"
+)
+
+var (
+	STALLED_WRITE_TIMEOUT = 10 * time.Second // how long a write can block before the connection is considered unhealthy
+)
+
+func (c *Multiplex) write_started() {
+	c.write_start.Store(time.Now().UnixNano())
+}
+
+func (c *Multiplex) write_done() {
+	c.write_start.Store(0)
+}
+
+// Healthy reports whether the connection is usable: it returns false if
+// the connection was closed, if a partial frame was sent (see
+// CHANNEL_DESYNC), or if a write has been blocked for longer than
+// STALLED_WRITE_TIMEOUT. It doesn't take the Multiplex lock, so it's cheap
+// enough to be polled by a health check.
+func (c *Multiplex) Healthy() bool {
+	if c.broken.Load() {
+		return false
+	}
+
+	if start := c.write_start.Load(); start != 0 && time.Since(time.Unix(0, start)) > STALLED_WRITE_TIMEOUT {
+		return false
+	}
+
+	return true
+}
+
+// SetStartupTimeout closes the connection if no frame is received from the
+// peer within d from now, to get rid of peers that connect but never speak
+// (half-open connections, or a peer speaking a different protocol). The
+// read that notices returns CHANNEL_STARTUP_TIMEOUT, the following ones
+// CHANNEL_CLOSED, as after Close. Zero disables it (the default).
+func (c *Multiplex) SetStartupTimeout(d time.Duration) error {
+	if d < 0 {
+		return INVALID_ARGUMENT
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if d == 0 {
+		c.startup = time.Time{}
+	} else {
+		c.startup = time.Now().Add(d)
+	}
+
+	return nil
+}
+
+// startup_timeout returns timeout for the next read, shortened to the
+// startup deadline if no frame was received yet.
+func (c *Multiplex) startup_timeout(timeout time.Duration) time.Duration {
+	if c.started || c.startup.IsZero() {
+		return timeout
+	}
+
+	left := time.Until(c.startup)
+	if left <= 0 {
+		// expired, just check
+		left = time.Duration(1)
+	}
+	if timeout == 0 || left < timeout {
+		timeout = left
+	}
+
+	return timeout
+}
+
+// startup_expired closes the connection, and returns true, if the startup
+// deadline expired before any frame was received.
+func (c *Multiplex) startup_expired() bool {
+	if c.started || c.startup.IsZero() || time.Now().Before(c.startup) {
+		return false
+	}
+
+	log.Println("startup_expired", "no frame received")
+	c.closed = true
+	c.broken.Store(true)
+	c.conn.Close()
+	return true
+}
+
+// REALLOCATION_WINDOW is the number of seconds ReallocationRate averages
+// over.
+const REALLOCATION_WINDOW = 10
+
+// rateCounter counts events per second, over the last REALLOCATION_WINDOW
+// seconds.
+type rateCounter struct {
+	seconds [REALLOCATION_WINDOW]int64 // the second counted in each slot
+	counts  [REALLOCATION_WINDOW]uint32
+}
+
+func (r *rateCounter) add(now time.Time) {
+	second := now.Unix()
+	i := second % REALLOCATION_WINDOW
+	if r.seconds[i] != second {
+		r.seconds[i] = second
+		r.counts[i] = 0
+	}
+
+	r.counts[i]++
+}
+
+func (r *rateCounter) rate(now time.Time) float64 {
+	second := now.Unix()
+	total := uint32(0)
+	for i := range r.counts {
+		if second-r.seconds[i] < REALLOCATION_WINDOW {
+			total += r.counts[i]
+		}
+	}
+
+	return float64(total) / REALLOCATION_WINDOW
+}
+
+// ReallocationRate returns how many times per second the channel buffer
+// was grown or shrunk (see OnReallocate), on average over the last
+// REALLOCATION_WINDOW seconds. A channel that keeps reallocating is
+// undersized, or sees frames much larger than it usually holds: a larger
+// initial buffer size (see Enable) avoids copying the data over and over.
+// It returns 0 for a channel that is not enabled, and starts over when the
+// channel is enabled again.
+func (c *Multiplex) ReallocationRate(channelId uint) float64 {
+	if channelId >= c.max_channels || !c.lock_channel(channelId) {
+		return 0
+	}
+
+	defer c.Unlock()
+	return c.channels[channelId].reallocs.rate(time.Now())
+}
@@ -0,0 +1,106 @@
+package multiplex
+
+// ----------------------------------------------------------------------
+//
+//   HOLD BUFFER
+//
+// ----------------------------------------------------------------------
+// Frames received for a disabled channel are dropped. When the peer starts
+// sending as soon as it opens a channel, the local Enable can lose the
+// race and the first frames of the channel are lost. With a hold buffer
+// those frames are kept, up to a limit, and replayed when the channel is
+// enabled.
+
+type held_frame struct {
+	channel uint
+	control bool
+	data    []byte
+}
+
+// SetHoldLimit sets the total bytes of payload held for disabled channels.
+// Frames received for a channel that is not enabled are copied to the hold
+// buffer and buffered for the channel, in order, when it is enabled. A frame
+// that doesn't fit is dropped and counted as "hold_full" in ErrorCounts.
+// Disable discards the frames held for the channel, but frames received
+// after it (i.e. after the channel was closed) are held again, so hold
+// frames only if the peer doesn't reuse closed channels. Zero disables it
+// (the default) and discards the held frames.
+func (c *Multiplex) SetHoldLimit(maxBytes int) error {
+	if maxBytes < 0 {
+		return INVALID_ARGUMENT
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.hold_limit = maxBytes
+	if maxBytes == 0 {
+		c.held = nil
+		c.held_bytes = 0
+	}
+
+	return nil
+}
+
+// HeldFrames returns how many frames are held for disabled channels.
+func (c *Multiplex) HeldFrames() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return len(c.held)
+}
+
+// hold_frame keeps a frame for a disabled channel, if there is room.
+func (c *Multiplex) hold_frame(channelId uint, control bool, data []byte) bool {
+	if c.hold_limit == 0 || channelId >= c.max_channels {
+		return false
+	}
+
+	if c.held_bytes+len(data) > c.hold_limit {
+		c.count_kind(CHANNEL_HOLD_FULL)
+		return false
+	}
+
+	c.held = append(c.held, held_frame{channelId, control, append([]byte(nil), data...)})
+	c.held_bytes += len(data)
+	return true
+}
+
+// replay_held buffers the frames held for the channel, that was just
+// enabled (or discards them, if replay is false).
+func (c *Multiplex) replay_held(channelId uint, replay bool) {
+	if len(c.held) == 0 {
+		return
+	}
+
+	replayed := false
+	kept := c.held[:0]
+	for _, frame := range c.held {
+		if frame.channel != channelId {
+			kept = append(kept, frame)
+			continue
+		}
+
+		c.held_bytes -= len(frame.data)
+		if !replay {
+			continue
+		}
+
+		if frame.control {
+			c.receive_control(channelId, frame.data)
+		} else {
+			c.write_channel(channelId, frame.data)
+		}
+		replayed = true
+	}
+
+	for i := len(kept); i < len(c.held); i++ {
+		// don't keep the dropped frames around
+		c.held[i] = held_frame{}
+	}
+	c.held = kept
+
+	if replayed {
+		c.cond.Broadcast()
+	}
+}
@@ -0,0 +1,89 @@
+package multiplex
+
+import (
+	"fmt"
+	"io"
+)
+
+// ----------------------------------------------------------------------
+//
+//   IO ADAPTERS
+//
+// ----------------------------------------------------------------------
+// Lightweight io.Reader/io.Writer views of a single channel, for use with
+// fmt.Fprintf, json.NewEncoder and friends when the deadline and net.Conn
+// machinery of Stream is not needed.
+
+type channelIO struct {
+	m  *Multiplex
+	ch uint
+}
+
+// Reader returns an io.Reader for the given channel. Read blocks, without
+// any deadline, until data is buffered for the channel or the channel is
+// disabled, as Stream.Read does.
+func (c *Multiplex) Reader(channelId uint) io.Reader {
+	return &channelIO{c, channelId}
+}
+
+// Writer returns an io.Writer for the given channel. Each Write is sent as
+// a single frame and blocks, without any deadline, until it is written.
+func (c *Multiplex) Writer(channelId uint) io.Writer {
+	return &channelIO{c, channelId}
+}
+
+func (r *channelIO) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	return r.m.read_wait(r.ch, b, NO_DEADLINE, false)
+}
+
+func (w *channelIO) Write(b []byte) (int, error) {
+	return w.m.Send(w.ch, b)
+}
+
+// WriteString sends s as a single frame on the given channel, as Send does.
+func (c *Multiplex) WriteString(channelId uint, s string) (int, error) {
+	if channelId >= c.max_channels {
+		return 0, INVALID_ARGUMENT
+	}
+
+	return c.Send(channelId, []byte(s))
+}
+
+// Printf formats according to a format specifier and sends the result as a
+// single frame on the given channel.
+func (c *Multiplex) Printf(channelId uint, format string, args ...interface{}) (int, error) {
+	return c.WriteString(channelId, fmt.Sprintf(format, args...))
+}
+
+// ----------------------------------------------------------------------
+//
+//   HIJACK
+//
+// ----------------------------------------------------------------------
+// A hijacked channel is a raw pipe: it delivers exactly the bytes destined
+// for that channel, while the multiplexer keeps demultiplexing the others.
+
+type hijackedChannel struct {
+	*channelIO
+}
+
+// HijackChannel returns an io.ReadWriteCloser for an enabled channel, with
+// the same blocking semantics as Reader and Writer. Close disables the
+// channel (discarding any buffered data), not the underlying connection.
+func (c *Multiplex) HijackChannel(channelId uint) (io.ReadWriteCloser, error) {
+	if channelId >= c.max_channels || !c.lock_channel(channelId) {
+		return nil, CHANNEL_CLOSED
+	}
+
+	c.Unlock()
+	return &hijackedChannel{&channelIO{c, channelId}}, nil
+}
+
+func (h *hijackedChannel) Close() error {
+	h.m.Disable(h.ch)
+	return nil
+}
@@ -0,0 +1,97 @@
+package multiplex
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * Listener implements the net.Listener interface on top of a multiplexer:
+ * Accept returns a Stream for each enabled channel that starts receiving
+ * data.
+ *
+ * Accept is what drives Select, so accepted streams only receive data while
+ * some goroutine is blocked in Accept, as servers usually are.
+ */
+type Listener struct {
+	m        *Multiplex
+	accepted [MAX_CHANNELS]*ChannelBuffer // the channel buffer at the time it was accepted
+	deadline time.Time                    // current accept timeout
+	closed   bool
+
+	sync.Mutex
+}
+
+func (c *Multiplex) Listen() *Listener {
+	return &Listener{m: c}
+}
+
+// Accept waits for data on a channel that wasn't accepted yet (or that was
+// disabled and enabled again since) and returns a Stream for it. If the
+// accept deadline expires it returns an error with Timeout() == true. It
+// returns CHANNEL_PROTOCOL or CHANNEL_DIRECTION (i.e. on a send only
+// multiplexer) right away, since they won't go away by retrying.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		l.Lock()
+		closed, deadline := l.closed, l.deadline
+		l.Unlock()
+
+		if closed {
+			return nil, StreamError(CHANNEL_CLOSED)
+		}
+
+		timeout := l.m.LoopInterval()
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return nil, StreamError(CHANNEL_TIMEOUT)
+			}
+			if remaining < timeout {
+				timeout = remaining
+			}
+		}
+
+		selected, err := l.m.Select(timeout)
+		if err == CHANNEL_CLOSED || err == CHANNEL_PROTOCOL || err == CHANNEL_DIRECTION {
+			return nil, StreamError(err.(MultiplexError))
+		} else if err != nil {
+			continue
+		}
+
+		l.m.Lock()
+		buf := l.m.channels[selected]
+		l.m.Unlock()
+
+		l.Lock()
+		if buf != nil && l.accepted[selected] != buf {
+			l.accepted[selected] = buf
+			l.Unlock()
+			return NewStream(l.m, selected), nil
+		}
+		l.Unlock()
+	}
+}
+
+// SetDeadline sets the deadline for Accept. A zero value means Accept
+// doesn't time out.
+func (l *Listener) SetDeadline(t time.Time) error {
+	l.Lock()
+	l.deadline = t
+	l.Unlock()
+	return nil
+}
+
+// Close stops accepting new streams. The multiplexer and the streams that
+// were already accepted are not affected.
+func (l *Listener) Close() error {
+	l.Lock()
+	l.closed = true
+	l.Unlock()
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.m.conn.LocalAddr()
+}
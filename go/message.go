@@ -0,0 +1,123 @@
+package multiplex
+
+import (
+	"io"
+)
+
+// ----------------------------------------------------------------------
+//
+//   SUB-FRAMING
+//
+// ----------------------------------------------------------------------
+// Stream and Reader see a channel as a byte stream, so Write boundaries are
+// lost (unless each side uses message mode or ReadFrame). FrameEncoder and
+// FrameDecoder add message boundaries on top of any io.Writer and
+// io.Reader (a Stream, the Writer and Reader of a channel, or a plain
+// connection) by prefixing each message with its length:
+//
+//   [len:4][message]
+//
+// The length is big endian, as in the frame header.
+
+var (
+	MAX_MESSAGE_SIZE = 16 * 1024 * 1024 // default largest message accepted by a FrameDecoder
+)
+
+// A FrameEncoder writes length prefixed messages to w.
+type FrameEncoder struct {
+	w   io.Writer
+	buf []byte // prefix and message, reused
+}
+
+func NewFrameEncoder(w io.Writer) *FrameEncoder {
+	return &FrameEncoder{w: w}
+}
+
+// WriteMessage writes msg, prefixed by its length, with a single Write (so
+// that on a Stream a message is sent as a single frame).
+func (e *FrameEncoder) WriteMessage(msg []byte) error {
+	length := uint64(len(msg))
+	if length > 0xFFFFFFFF {
+		return CHANNEL_FRAME_TOO_LARGE
+	}
+
+	e.buf = append(e.buf[:0], byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	e.buf = append(e.buf, msg...)
+
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// A FrameDecoder reads the length prefixed messages written by a
+// FrameEncoder from r.
+type FrameDecoder struct {
+	r      io.Reader
+	max    int     // largest message accepted
+	prefix [4]byte // length of the current message
+	buf    []byte  // current message, reused
+	read   int     // bytes of the current message read so far, prefix included
+}
+
+func NewFrameDecoder(r io.Reader) *FrameDecoder {
+	return &FrameDecoder{r: r, max: MAX_MESSAGE_SIZE}
+}
+
+// SetMaxMessage sets the largest message accepted (MAX_MESSAGE_SIZE by
+// default), so that a bad length can't make ReadMessage allocate without
+// bounds.
+func (d *FrameDecoder) SetMaxMessage(n int) error {
+	if n <= 0 {
+		return INVALID_ARGUMENT
+	}
+
+	d.max = n
+	return nil
+}
+
+// ReadMessage reads the next message. The returned slice is only valid
+// until the next call, that reuses it.
+//
+// If r returns an error in the middle of a message (i.e. a Stream read
+// deadline expired) the error is returned and the next call resumes the
+// message where it stopped. At a message boundary io.EOF is returned as is,
+// within a message it becomes io.ErrUnexpectedEOF. A message larger than
+// the limit (see SetMaxMessage) returns CHANNEL_FRAME_TOO_LARGE, and leaves
+// the decoder unusable.
+func (d *FrameDecoder) ReadMessage() ([]byte, error) {
+	for d.read < len(d.prefix) {
+		n, err := d.r.Read(d.prefix[d.read:])
+		d.read += n
+		if d.read < len(d.prefix) && err != nil {
+			return nil, d.read_error(err)
+		}
+	}
+
+	length := int(d.prefix[0])<<24 | int(d.prefix[1])<<16 | int(d.prefix[2])<<8 | int(d.prefix[3])
+	if length < 0 || length > d.max {
+		return nil, CHANNEL_FRAME_TOO_LARGE
+	}
+
+	if cap(d.buf) < length {
+		d.buf = make([]byte, length)
+	}
+
+	msg := d.buf[:length]
+	for d.read < len(d.prefix)+length {
+		n, err := d.r.Read(msg[d.read-len(d.prefix):])
+		d.read += n
+		if d.read < len(d.prefix)+length && err != nil {
+			return nil, d.read_error(err)
+		}
+	}
+
+	d.read = 0
+	return msg, nil
+}
+
+func (d *FrameDecoder) read_error(err error) error {
+	if err == io.EOF && d.read > 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,69 @@
+package multiplex
+
+import (
+	"net"
+)
+
+// SendMultiPart sends the concatenation of parts as a single frame on the
+// given channel, as Send does, without the caller joining them first (i.e.
+// a header and a body held in separate slices). The frame header and the
+// parts are written with a single writev when the connection supports it.
+// With datagrams, write coalescing or a codec the parts are copied into one frame
+// anyway. It returns the total payload bytes sent.
+func (c *Multiplex) SendMultiPart(channelId uint, parts ...[]byte) (int, error) {
+	length := 0
+	for _, part := range parts {
+		length += len(part)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if length == 0 {
+		return 0, nil
+	}
+
+	if c.packet || c.coalesce > 0 || c.codec != nil {
+		// frames must be written (or queued) as a whole
+		buffer := make([]byte, 0, length)
+		for _, part := range parts {
+			buffer = append(buffer, part...)
+		}
+
+		return c.send_channel(channelId, buffer, NO_DEADLINE)
+	}
+
+	if c.direction == RECV_ONLY {
+		return 0, c.count_error(CHANNEL_DIRECTION)
+	}
+
+	c.begin_write()
+	defer c.end_write()
+
+	if err := c.writable(); err != nil {
+		return 0, c.count_error(err)
+	}
+	if err := c.check_rejected(channelId); err != nil {
+		return 0, c.count_error(err)
+	}
+
+	header := c.frame_prefix(channelId, length, 0, false)
+	buffers := make(net.Buffers, 1, len(parts)+1)
+	buffers[0] = header
+	for _, part := range parts {
+		if len(part) > 0 {
+			buffers = append(buffers, part)
+		}
+	}
+
+	if written, err := c.write_buffers(buffers, len(header)+length); err != nil {
+		if written < len(header) {
+			return 0, c.count_error(err)
+		}
+
+		return written - len(header), c.count_error(err)
+	}
+
+	c.frame_sent(channelId, length, len(header) > c.header_length())
+	return length, nil
+}
@@ -32,7 +32,8 @@ package multiplex
 // descriptor. By prefixing a packet with 4 bytes of length (aligned
 // right, zero left-padded, includes length of channel ID) and a single
 // byte containing the channel ID, we can reassemble the packet and
-// decide which channel it belongs to.
+// decide which channel it belongs to. Fragments that arrive out of order
+// from elsewhere can be placed by offset instead (see SetPositional).
 //
 // Channels have to be activated before use, creating a receive buffer
 // that is dynamically extended and reduced when needed. Using a
@@ -43,10 +44,13 @@ package multiplex
 // is not active") are negative, while channel IDs are positive or zero.
 
 import (
+	"bufio"
 	"io"
 	"log"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -54,7 +58,7 @@ const (
 	INITIAL_BUFFER_SIZE = 256
 	MAX_CHANNELS        = 256
 
-	headerLength = 5 // 6 // 1:magic + 4:size + 1:channel
+	headerLength = 5 // 4:size + 1:channel (see header.go for the other formats)
 	magic        = 0x69
 )
 
@@ -64,10 +68,72 @@ func (e MultiplexError) Error() string {
 	return "multiplex error: " + string(e)
 }
 
+// Timeout and Temporary make the errors a net.Error, as the errors of a
+// net.Conn are: code written for one (i.e. http2) recognizes CHANNEL_TIMEOUT.
+// The errors of an operation that couldn't proceed right away, but can be
+// retried later (CHANNEL_WOULDBLOCK, CHANNEL_QUEUE_FULL, CHANNEL_PAUSED),
+// are Temporary too.
+func (e MultiplexError) Timeout() bool {
+	return e == CHANNEL_TIMEOUT
+}
+
+func (e MultiplexError) Temporary() bool {
+	switch e {
+	case CHANNEL_TIMEOUT, CHANNEL_WOULDBLOCK, CHANNEL_QUEUE_FULL, CHANNEL_PAUSED:
+		return true
+	}
+
+	return false
+}
+
+// Is makes errors.Is match CHANNEL_TIMEOUT with os.ErrDeadlineExceeded,
+// CHANNEL_CLOSED with net.ErrClosed, CHANNEL_EOF with io.EOF and
+// CHANNEL_TRUNCATED with io.ErrUnexpectedEOF (and net.ErrClosed).
+// CHANNEL_QUEUE_FULL and CHANNEL_PAUSED match CHANNEL_WOULDBLOCK, that they
+// refine.
+func (e MultiplexError) Is(target error) bool {
+	switch e {
+	case CHANNEL_TIMEOUT:
+		return target == os.ErrDeadlineExceeded
+	case CHANNEL_CLOSED:
+		return target == net.ErrClosed
+	case CHANNEL_EOF:
+		return target == io.EOF
+	case CHANNEL_TRUNCATED:
+		return target == io.ErrUnexpectedEOF || target == net.ErrClosed
+	case CHANNEL_QUEUE_FULL, CHANNEL_PAUSED:
+		return target == CHANNEL_WOULDBLOCK
+	}
+
+	return false
+}
+
 var (
 	CHANNEL_IGNORED = MultiplexError("channel ignored")
 	CHANNEL_TIMEOUT = MultiplexError("channel timeout")
 	CHANNEL_CLOSED  = MultiplexError("channel closed")
+	CHANNEL_EOF     = MultiplexError("channel closed by peer")
+
+	CHANNEL_FRAME_TOO_LARGE = MultiplexError("frame too large")
+	CHANNEL_DESYNC          = MultiplexError("channel desynchronized")
+	CHANNEL_TRUNCATED       = MultiplexError("connection closed in the middle of a frame")
+	CHANNEL_PROTOCOL        = MultiplexError("protocol error")
+	CHANNEL_VERSION         = MultiplexError("unsupported protocol version")
+	CHANNEL_NO_CONTROL      = MultiplexError("control frames not enabled")
+	CHANNEL_SEQUENCE        = MultiplexError("sequence gap")
+	CHANNEL_DIRECTION       = MultiplexError("operation not allowed in this direction")
+	CHANNEL_WOULDBLOCK      = MultiplexError("operation would block")
+	CHANNEL_QUEUE_FULL      = MultiplexError("send queue full")
+	CHANNEL_PAUSED          = MultiplexError("channel paused")
+	CHANNEL_NO_FILE         = MultiplexError("a stream has no file descriptor")
+	CHANNEL_CANCELLED       = MultiplexError("wait cancelled")
+	CHANNEL_HOLD_FULL       = MultiplexError("hold buffer full")
+	CHANNEL_REJECTED        = MultiplexError("channel not enabled by the peer")
+	CHANNEL_STARTUP_TIMEOUT = MultiplexError("no frame received within the startup timeout")
+	CHANNEL_BUFFER_LIMIT    = MultiplexError("total buffer limit reached")
+	CHANNEL_RESYNC          = MultiplexError("stream resynchronized, data skipped")
+
+	INVALID_ARGUMENT = MultiplexError("invalid argument")
 )
 
 type ChannelBuffer struct {
@@ -75,13 +141,114 @@ type ChannelBuffer struct {
 	offset  int    // current read offset
 	length  int    // current read length
 	initial int    // minimum capacity
-	newData int    // 0 = no new data since last 'select'
+	newData int    // bytes received since last 'select', at the end of the buffer (0 <= newData <= length)
+	frames  []int  // length of each buffered frame (see ReadFrame)
+	eof     bool   // the peer closed its side of the channel (see CloseWrite)
+
+	max_message int // largest frame accepted (0 = no limit, see SetChannelMaxMessage)
+
+	close_err *CloseError // why the peer closed the channel (nil = normal close)
+
+	lastActivity time.Time // last time data was buffered, read or sent
+	lastSelected time.Time // last time the channel was selected or ignored (see SetRenotifyInterval)
+	signaled     bool      // the reader received a frame since last 'select' (see StartReader)
+	paused       bool      // frames are buffered but not delivered (see Pause)
+	draining     bool      // closed locally, disabled once the buffered data is read (see CloseChannelAfterDrain)
+	sensitive    bool      // the data is zeroed once consumed (see SetSensitive)
+	nonblocking  bool      // reads return CHANNEL_WOULDBLOCK instead of waiting (see SetNonBlocking)
+	priority     int       // Select returns the channels with a higher priority first (see SetReceivePriority)
+
+	positional  bool       // the data is placed by offset (see SetPositional)
+	next_offset int        // offset of the next contiguous byte, in positional mode
+	fragments   []fragment // data past next_offset, sorted by offset
+	held        int        // bytes in fragments
+
+	reallocs rateCounter // reallocations over the last seconds (see ReallocationRate)
+	stats    Stats       // data frames sent and received since the channel was enabled (see ChannelStats)
+
+	context interface{} // user data (see SetChannelContext)
 }
 
 type Multiplex struct {
 	conn         net.Conn                     // network connection
 	max_channels uint                         // maximum number of channels (0 <= max_channels <= MAX_CHANNELS)
 	channels     [MAX_CHANNELS]*ChannelBuffer // O(1) lookup for channels
+	active       uint                         // number of enabled channels
+	single       uint                         // the enabled channel, when active == 1
+	max_active   uint                         // maximum number of enabled channels (0 = no limit)
+	buffer_total int                          // total size of the channel buffers
+	buffer_limit int                          // maximum buffer_total (0 = no limit, see SetTotalBufferLimit)
+	packet       bool                         // one frame per datagram (see NewMultiplexPacket)
+	codec        Codec                        // reads and writes the frames instead of the built-in header (see WithCodec)
+	direction    Direction                    // which way data flows (see WithDirection)
+	initial_size int                          // default initial buffer size (0 = INITIAL_BUFFER_SIZE)
+	desync       bool                         // a partial frame was sent, the peer can't find frame boundaries anymore
+	closed       bool                         // the connection was closed (or failed)
+	shutdown     bool                         // closed by Close, not by a transport error (see ReconnectingStream)
+	peer_closed  bool                         // the connection was closed by the peer (or failed) while reading
+	strict_eof   bool                         // a frame cut by EOF is CHANNEL_TRUNCATED, not CHANNEL_CLOSED (see WithStrictEOF)
+	version      byte                         // protocol version sent in the header (0 = legacy header, no magic/version)
+	magic_header bool                         // the header starts with the magic byte (see WithMagicHeader)
+	resync       int                          // bytes scanned for a valid header after an invalid one (0 = no resync, see WithResync)
+	resync_hdr   []byte                       // valid header found by the resync, read by the next parse_frame
+	resync_from  io.Reader                    // the reader resync_hdr was read from
+	control      bool                         // control frames are enabled (see WithControlFrames)
+	nack         bool                         // NACK the frames received for disabled channels (see WithNack)
+	nacking      [MAX_CHANNELS]bool           // a NACK is being sent for the channel
+	rejected     [MAX_CHANNELS]bool           // the peer NACKed a frame sent on the channel
+	sequence     bool                         // data frames carry a sequence number (see WithSequenceNumbers)
+	send_seq     [MAX_CHANNELS]uint32         // next sequence number to send, per channel
+	recv_seq     [MAX_CHANNELS]uint32         // next sequence number expected, per channel
+	renotify     time.Duration                // when unconsumed data is selected again (0 = never, see SetRenotifyInterval)
+	select_next  uint                         // first channel checked for buffered data (round robin)
+	fair_share   int                          // buffered bytes past which a channel is selected after the others (0 = no limit, see SetFairShare)
+	prioritized  bool                         // some channel has a receive priority (see SetReceivePriority)
+	direct_to    *waiter                      // the ReadAny whose frame is being received, that takes it instead of the buffer
+	coalesce     time.Duration                // how long frames are queued before being written (0 = write immediately)
+	queued       net.Buffers                  // frames waiting to be written
+	flush_timer  *time.Timer                  // pending write of the queued frames
+	write_err    error                        // error from the last coalesced write
+	queued_bytes int                          // total length of the queued frames
+	queue_limit  int                          // maximum queued bytes (0 = no limit, see SetSendQueueLimit)
+	queue_policy QueuePolicy                  // what Send does when the queue is full
+	held         []held_frame                 // frames received for disabled channels (see SetHoldLimit)
+	held_bytes   int                          // total payload of the held frames
+	hold_limit   int                          // maximum held bytes (0 = don't hold frames)
+	read_buffer  int                          // size of the read buffer (0 = read each frame from conn, see WithReadBuffer)
+	rd           *bufio.Reader                // read buffer, owned by whoever is reading the connection
+	rd_conn      net.Conn                     // the connection rd reads from
+	startup      time.Time                    // when the connection is closed if no frame was received yet (see SetStartupTimeout)
+	started      bool                         // a frame was received
+
+	broken        atomic.Bool  // closed or desync, readable without the lock
+	current       atomic.Value // conn, for Close to interrupt a blocked read or write
+	write_start   atomic.Int64 // when the current write started (UnixNano, 0 = not writing)
+	loop_interval atomic.Int64 // Select timeout for RunLoop and friends (0 = LOOP_INTERVAL)
+	totals        counters     // connection totals, readable without the lock
+
+	on_reallocate func(channelId uint, oldCap, newCap int) // called when a channel buffer is resized
+	tees          [MAX_CHANNELS][]*channelTee              // writers mirroring the received data (see TeeChannel)
+	sinks         [MAX_CHANNELS]*channelTee                // writers taking the received data instead of the buffer (see SetChannelSink)
+	send_tap      *channelTee                              // writer mirroring the frames sent (see SetSendTap)
+	frame_pool    atomic.Pointer[sync.Pool]                // scratch buffers for incoming frames (see SetFrameBufferPool)
+	recv_free     [][]byte                                 // released buffers, reused by ReceiveBuf
+	recv_size     int                                      // size of the largest data returned by ReceiveBuf
+	write_retries int                                      // retries of a write that failed with a temporary error (see SetWriteRetry)
+	write_backoff time.Duration                            // delay before the first retry
+	reader        bool                                     // a background reader owns the connection (see StartReader)
+	read_err      error                                    // why the background reader stopped, if not closed
+	reading       bool                                     // a Receive is reading a frame without the lock (see read_unlocked)
+	writing       bool                                     // a frame is being written without the lock (see begin_write)
+	zero_on_clear bool                                     // channels are enabled as sensitive (see WithZeroOnClear)
+	cond          *sync.Cond                               // broadcast when a frame is buffered, when the reader stops, and on close
+	waiters       map[*waiter]struct{}                     // goroutines waiting for a frame (see BlockedOps)
+
+	on_frame  func(seq uint64, channelId uint, data []byte) // called when a data frame is buffered (see OnFrame)
+	frame_seq uint64                                        // global sequence of the buffered frames
+
+	loops      sync.WaitGroup // running RunLoop, Serve (and its handlers) and reader
+	done       chan struct{}  // closed when closed and all loops have returned
+	close_once sync.Once
 
 	sync.Mutex // for exclusive access
 }
@@ -123,51 +290,320 @@ func (c *Multiplex) lock_channel(channelId uint) bool {
 //
 // ----------------------------------------------------------------------
 // -- CREATE
-func NewMultiplex(conn net.Conn) *Multiplex {
-	return NewMultiplexEx(conn, MAX_CHANNELS)
+// An Option configures a Multiplex at construction time.
+type Option func(c *Multiplex)
+
+func NewMultiplex(conn net.Conn, options ...Option) *Multiplex {
+	return NewMultiplexEx(conn, MAX_CHANNELS, options...)
 }
 
-func NewMultiplexEx(conn net.Conn, max_channels uint) *Multiplex {
+func NewMultiplexEx(conn net.Conn, max_channels uint, options ...Option) *Multiplex {
 	if max_channels < 0 || max_channels > MAX_CHANNELS {
 		return nil
 	}
 
-	return &Multiplex{conn: conn, max_channels: max_channels}
+	c := &Multiplex{conn: conn, max_channels: max_channels, done: make(chan struct{})}
+	c.write_retries = WRITE_RETRIES
+	c.write_backoff = WRITE_BACKOFF
+	c.cond = sync.NewCond(&c.Mutex)
+	for _, option := range options {
+		option(c)
+	}
+
+	c.current.Store(c.conn)
+	return c
+}
+
+// MaxChannels returns the number of channels of the multiplexer, as set by
+// NewMultiplexEx (MAX_CHANNELS for NewMultiplex): valid channel IDs go from
+// 0 to MaxChannels()-1. A frame received for a channel past that is a
+// protocol error (CHANNEL_PROTOCOL), not an ignored frame.
+func (c *Multiplex) MaxChannels() uint {
+	return c.max_channels
+}
+
+// -- REPLACE CONNECTION
+
+// ReplaceConn swaps the underlying connection, i.e. after a reconnect, and
+// closes the old one. Enabled channels and their buffered data are kept,
+// but frames that were partially received or sent on the old connection
+// are lost.
+func (c *Multiplex) ReplaceConn(conn net.Conn) {
+	c.Lock()
+	old := c.replace_conn(conn)
+	c.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+}
+
+// -- CLOSE
+
+// Close writes any queued frame and closes the connection. Select, Receive,
+// RunLoop and Serve then return CHANNEL_CLOSED (or nil for Serve). If the
+// Multiplex is busy (i.e. blocked reading or writing) the connection is
+// closed right away, to interrupt it.
+func (c *Multiplex) Close() error {
+	if !c.TryLock() {
+		c.current.Load().(net.Conn).Close()
+		c.Lock()
+	} else if c.writing {
+		// a write is in progress without the lock, interrupt it
+		c.conn.Close()
+	}
+
+	c.flush_frames()
+	c.closed = true
+	c.shutdown = true
+	c.broken.Store(true)
+	err := c.conn.Close()
+	c.cond.Broadcast()
+	c.Unlock()
+
+	c.close_once.Do(func() {
+		go func() {
+			c.loops.Wait()
+			close(c.done)
+		}()
+	})
+
+	return err
+}
+
+// Done returns a channel that is closed once Close was called and all the
+// running RunLoop, Serve (and its handlers) and reader loops have returned
+// (they stop as soon as they notice the connection is closed). Don't start
+// new loops after Close.
+func (c *Multiplex) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait blocks until Done is closed.
+func (c *Multiplex) Wait() {
+	<-c.done
+}
+
+func (c *Multiplex) replace_conn(conn net.Conn) net.Conn {
+	old := c.conn
+	c.conn = conn
+	c.current.Store(conn)
+	c.read_err = nil
+	c.closed = false
+	c.shutdown = false
+	c.peer_closed = false
+	c.desync = false
+	c.broken.Store(false)
+	return old
+}
+
+// -- DIRECTION
+// A one-directional multiplexer (i.e. a producer streaming to consumers)
+// doesn't need to allocate receive buffers, or to read from the connection.
+type Direction int
+
+const (
+	BIDIRECTIONAL Direction = iota
+	SEND_ONLY               // Select, Receive and Read return CHANNEL_DIRECTION
+	RECV_ONLY               // Send returns CHANNEL_DIRECTION
+)
+
+// WithDirection restricts the multiplexer to sending or receiving only.
+// Operations in the other direction return CHANNEL_DIRECTION.
+func WithDirection(direction Direction) Option {
+	return func(c *Multiplex) {
+		c.direction = direction
+	}
 }
 
 // -- ACTIVATE CHANNEL
-func (c *Multiplex) enable_channel(channelId uint, initialBufferSize int) {
+func (c *Multiplex) enable_channel(channelId uint, initialBufferSize int) bool {
 	if c != nil && channelId >= 0 && channelId <= (c.max_channels-1) && c.channels[channelId] == nil {
+		if c.max_active > 0 && c.active >= c.max_active {
+			log.Println("enable_channel", channelId, "too many active channels", c.active)
+			return false
+		}
+
+		if initialBufferSize <= 0 {
+			initialBufferSize = c.initial_size
+		}
 		if initialBufferSize <= 0 {
 			initialBufferSize = INITIAL_BUFFER_SIZE
 		}
 
-		buf := &ChannelBuffer{data: make([]byte, initialBufferSize), initial: initialBufferSize}
+		allocate := initialBufferSize
+		if c.direction == SEND_ONLY {
+			// nothing will ever be received
+			allocate = 0
+		}
+		if c.buffer_limit > 0 && c.buffer_total+allocate > c.buffer_limit {
+			log.Println("enable_channel", channelId, "total buffer limit reached", c.buffer_total)
+			return false
+		}
+
+		buf := &ChannelBuffer{data: make([]byte, allocate), initial: initialBufferSize, lastActivity: time.Now(), sensitive: c.zero_on_clear}
 		c.channels[channelId] = buf
+		c.active++
+		if c.active == 1 {
+			c.single = channelId
+		}
+		c.buffer_total += allocate
+		c.replay_held(channelId, true)
+		return true
+	}
+
+	return false
+}
+
+func (c *Multiplex) disable_channel(channelId uint) {
+	if buf := c.channels[channelId]; buf != nil {
+		buf.wipe(buf.data[buf.offset : buf.offset+buf.length])
+		c.channels[channelId] = nil
+		c.active--
+		if c.active == 1 {
+			c.single = c.first_enabled()
+		}
+		c.buffer_total -= len(buf.data)
+		c.replay_held(channelId, false)
+		c.cond.Broadcast()
 	}
 }
 
+// first_enabled returns the lowest enabled channel (max_channels if none).
+func (c *Multiplex) first_enabled() uint {
+	for i := uint(0); i < c.max_channels; i++ {
+		if c.channels[i] != nil {
+			return i
+		}
+	}
+
+	return c.max_channels
+}
+
 func (c *Multiplex) Enable(channelId uint, initialBufferSize int) {
 	c.Lock()
 	c.enable_channel(channelId, initialBufferSize)
 	c.Unlock()
 }
 
-func (c *Multiplex) EnableRange(minChannel, maxChannel uint, initialBufferSize int) {
+// EnableRange enables all the channels from minChannel to maxChannel
+// (included) and returns how many were actually enabled: channels that are
+// already enabled are skipped. An invalid range enables nothing and returns
+// INVALID_ARGUMENT.
+func (c *Multiplex) EnableRange(minChannel, maxChannel uint, initialBufferSize int) (int, error) {
+	if minChannel > maxChannel || maxChannel >= c.max_channels {
+		return 0, INVALID_ARGUMENT
+	}
+
 	c.Lock()
+	defer c.Unlock()
+
+	enabled := 0
 	for i := minChannel; i <= maxChannel; i++ {
-		c.enable_channel(i, initialBufferSize)
+		if c.enable_channel(i, initialBufferSize) {
+			enabled++
+		}
 	}
-	c.Unlock()
+
+	return enabled, nil
 }
 
 func (c *Multiplex) Disable(channelId uint) {
 	if c.lock_channel(channelId) {
-		c.channels[channelId] = nil
+		c.disable_channel(channelId)
 		c.Unlock()
 	}
 }
 
+// DisableRange disables all the channels from minChannel to maxChannel
+// (included). Channels that are not enabled are skipped.
+func (c *Multiplex) DisableRange(minChannel, maxChannel uint) {
+	c.Lock()
+	for i := minChannel; i <= maxChannel && i < c.max_channels; i++ {
+		c.disable_channel(i)
+	}
+	c.Unlock()
+}
+
+// EnableAll enables all the channels, from 0 to max_channels-1, and
+// returns how many were actually enabled: channels that are already
+// enabled are skipped.
+func (c *Multiplex) EnableAll(initialBufferSize int) int {
+	c.Lock()
+	defer c.Unlock()
+
+	enabled := 0
+	for i := uint(0); i < c.max_channels; i++ {
+		if c.enable_channel(i, initialBufferSize) {
+			enabled++
+		}
+	}
+
+	return enabled
+}
+
+// DisableAll disables all the channels.
+func (c *Multiplex) DisableAll() {
+	c.Lock()
+	for i := uint(0); i < c.max_channels; i++ {
+		c.disable_channel(i)
+	}
+	c.Unlock()
+}
+
+// SetInitialBufferSize sets the buffer size used by Enable and EnableRange
+// when they are called with an initialBufferSize of 0.
+func (c *Multiplex) SetInitialBufferSize(n int) error {
+	if n <= 0 {
+		return INVALID_ARGUMENT
+	}
+
+	c.Lock()
+	c.initial_size = n
+	c.Unlock()
+	return nil
+}
+
+// SetMaxConcurrentChannels limits the number of channels that can be enabled
+// at the same time (0 means no limit, the default). Enabling a channel beyond
+// the limit is refused, so frames for it keep being dropped as ignored until
+// some other channel is disabled.
+//
+// Channels that are already enabled are not affected.
+func (c *Multiplex) SetMaxConcurrentChannels(n uint) {
+	c.Lock()
+	c.max_active = n
+	c.Unlock()
+}
+
+// SetTotalBufferLimit caps the total size, in bytes, of the buffers of all
+// the enabled channels (0 means no limit, the default), so that many busy
+// channels can't grow their buffers past the memory meant for the
+// connection. Once the limit is reached a frame that would grow a buffer is
+// dropped: whoever read it from the connection (Select, or Receive on that
+// channel) gets CHANNEL_BUFFER_LIMIT, and reading the data already buffered
+// makes room again. Enabling a channel whose initial buffer doesn't fit is
+// refused. Buffers that are already larger are not shrunk.
+func (c *Multiplex) SetTotalBufferLimit(maxBytes int) error {
+	if maxBytes < 0 {
+		return INVALID_ARGUMENT
+	}
+
+	c.Lock()
+	c.buffer_limit = maxBytes
+	c.Unlock()
+	return nil
+}
+
+// TotalBufferSize returns the total size, in bytes, of the buffers of all
+// the enabled channels.
+func (c *Multiplex) TotalBufferSize() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.buffer_total
+}
+
 // ----------------------------------------------------------------------
 //
 //   REALLOCATION
@@ -184,13 +620,14 @@ func (c *Multiplex) reallocate_channel(channelId uint, additionalDataSize int) b
 	newLen := buf.offset + buf.length + additionalDataSize
 	allocateLen := len(buf.data) // cap() ?
 
-	if allocateLen > newLen*4 { // Case 1: buffer is too empty (less than 25%)
+	if allocateLen > newLen*4 && allocateLen > buf.initial { // Case 1: buffer is too empty (less than 25%)
 		allocateLen = buf.initial
 	} else if allocateLen >= newLen { // Case 2: buffer is big enough
 		return true
 	} else if allocateLen >= (buf.length + additionalDataSize) { // Case 3: move data within buffer (set offset to 0)
 		if buf.offset > 0 {
 			copy(buf.data, buf.data[buf.offset:buf.offset+buf.length])
+			buf.wipe(buf.data[buf.length : buf.offset+buf.length])
 			buf.offset = 0
 		}
 		return true
@@ -201,35 +638,112 @@ func (c *Multiplex) reallocate_channel(channelId uint, additionalDataSize int) b
 		allocateLen *= 2
 	}
 
+	if grow := allocateLen - len(buf.data); grow > 0 && c.buffer_limit > 0 && c.buffer_total+grow > c.buffer_limit {
+		log.Println("reallocate_channel", channelId, "total buffer limit reached", c.buffer_total)
+		return false
+	}
+	c.buffer_total += allocateLen - len(buf.data)
+
+	buf.reallocs.add(time.Now())
+	if c.on_reallocate != nil {
+		c.on_reallocate(channelId, len(buf.data), allocateLen)
+	}
+
 	newbuf := make([]byte, allocateLen)
 	copy(newbuf, buf.data[buf.offset:buf.offset+buf.length])
+	buf.wipe(buf.data[buf.offset : buf.offset+buf.length])
 	buf.data = newbuf
 	buf.offset = 0
 
 	return true
 }
 
+// OnReallocate registers a function that is called every time a channel
+// buffer is grown or shrunk, which usually means the initial buffer size is
+// too small. The function is called with the Multiplex locked, so it must
+// not block or call back into the Multiplex. Pass nil to remove it.
+func (c *Multiplex) OnReallocate(f func(channelId uint, oldCap, newCap int)) {
+	c.Lock()
+	c.on_reallocate = f
+	c.Unlock()
+}
+
+// OnFrame registers a function that is called every time a data frame is
+// buffered, on any channel, with a global sequence number that grows by
+// one for each frame: the order in which frames arrived across channels,
+// that is lost once they are demultiplexed, can be reconstructed from it.
+// The sequence starts at 1 and keeps counting if the function is replaced,
+// but frames buffered while no function is registered are not counted.
+// The function is called with the Multiplex locked, so it must not block
+// or call back into the Multiplex, and data is only valid during the call.
+// Pass nil to remove it.
+func (c *Multiplex) OnFrame(f func(seq uint64, channelId uint, data []byte)) {
+	c.Lock()
+	c.on_frame = f
+	c.Unlock()
+}
+
 // ----------------------------------------------------------------------
 //
 //   MODIFY BUFFER
 //
 // ----------------------------------------------------------------------
-func (c *Multiplex) write_channel(channelId uint, data []byte) {
+// write_channel buffers data for the channel. It returns
+// CHANNEL_BUFFER_LIMIT if the data was dropped because the buffer couldn't
+// grow (see SetTotalBufferLimit).
+func (c *Multiplex) write_channel(channelId uint, data []byte) error {
 	length := len(data)
+	if length == 0 {
+		// empty frames carry no data, and shouldn't reset newData
+		return nil
+	}
+	if c.direction == SEND_ONLY {
+		return nil
+	}
+	if buf := c.channels[channelId]; buf != nil && buf.draining {
+		// closed, not accepting data anymore
+		return nil
+	}
 
-	if c.reallocate_channel(channelId, length) {
-		buf := c.channels[channelId]
-		if buf != nil {
-			copy(buf.data[buf.offset:], data)
-			buf.length += length
-			buf.newData = length
+	buf := c.channels[channelId]
+	if buf == nil {
+		return nil
+	}
+
+	if sink := c.sinks[channelId]; sink != nil {
+		// streamed, not buffered
+		sink.queue <- append([]byte(nil), data...)
+	} else if w := c.direct_to; w != nil && w.frame == nil && buf.length == 0 && !buf.paused {
+		// nothing to keep in order with, ReadAny takes it as is
+		w.frame_id = channelId
+		w.frame = append([]byte(nil), data...)
+	} else {
+		if !c.reallocate_channel(channelId, length) {
+			return CHANNEL_BUFFER_LIMIT
+		}
+
+		copy(buf.data[buf.offset+buf.length:], data)
+		buf.length += length
+		if !buf.paused {
+			buf.newData += length
 		}
+		buf.frames = append(buf.frames, length)
+	}
+	buf.lastActivity = time.Now()
+	c.tee_channel(channelId, data)
+
+	if c.on_frame != nil {
+		c.frame_seq++
+		c.on_frame(c.frame_seq, channelId, data)
 	}
+
+	return nil
 }
 
 func (c *Multiplex) Write(channelId uint, data []byte) {
 	if c.lock_channel(channelId) {
 		c.write_channel(channelId, data)
+		c.cond.Broadcast()
 		c.Unlock()
 	}
 }
@@ -273,43 +787,69 @@ func (c *Multiplex) read_channel(channelId uint, dst []byte) (int, error) {
 	}
 
 	copy(dst, buf.data[buf.offset:buf.offset+copyLen])
+	buf.wipe(buf.data[buf.offset : buf.offset+copyLen])
 	buf.offset += copyLen
 	buf.length -= copyLen
-	buf.newData -= copyLen
+	buf.consume_frames(copyLen)
+	buf.lastActivity = time.Now()
 
-	if buf.newData < 0 {
-		buf.newData = 0
+	if buf.newData > buf.length {
+		// the new data is the last received, so it's consumed last
+		buf.newData = buf.length
 	}
 	if buf.length <= 0 {
 		buf.length = 0
 		buf.newData = 0
 		buf.offset = 0
+		buf.frames = buf.frames[:0]
 	}
 
 	return copyLen, nil
 }
 
 func (c *Multiplex) Read(channelId uint, dst []byte) (int, error) {
+	if c.direction == SEND_ONLY {
+		return 0, CHANNEL_DIRECTION
+	}
+
 	if !c.lock_channel(channelId) {
 		return 0, CHANNEL_CLOSED
 	}
 
 	defer c.Unlock()
-	return c.read_channel(channelId, dst)
+
+	n, err := c.read_channel(channelId, dst)
+	if n == 0 && err == nil && len(dst) > 0 {
+		// nothing buffered, and nothing more is coming
+		if buf := c.channels[channelId]; buf.eof {
+			return 0, c.channel_eof(channelId)
+		} else if c.closed {
+			return 0, CHANNEL_CLOSED
+		}
+	}
+
+	return n, err
 }
 
 func (c *Multiplex) clear_channel(channelId uint) {
 	buf := c.channels[channelId]
+	buf.wipe(buf.data[buf.offset : buf.offset+buf.length])
 	buf.offset = 0
 	buf.length = 0
 	buf.newData = 0
+	buf.frames = buf.frames[:0]
 }
 
-func (c *Multiplex) Clear(channelId uint) {
-	if c.lock_channel(channelId) {
-		c.clear_channel(channelId)
-		c.Unlock()
+// Clear discards the data buffered for the channel. It returns
+// CHANNEL_CLOSED if the channel is not enabled.
+func (c *Multiplex) Clear(channelId uint) error {
+	if !c.lock_channel(channelId) {
+		return CHANNEL_CLOSED
 	}
+
+	c.clear_channel(channelId)
+	c.Unlock()
+	return nil
 }
 
 // ----------------------------------------------------------------------
@@ -317,197 +857,1008 @@ func (c *Multiplex) Clear(channelId uint) {
 //   RECEIVE LOGIC
 //
 // ----------------------------------------------------------------------
-func conn_read(conn net.Conn, timeout time.Duration, buffer []byte) (int, error) {
-	if timeout != time.Duration(0) {
-		conn.SetReadDeadline(time.Now().Add(timeout))
+// readDeadliner is implemented by the readers that support timeouts (a
+// net.Conn, an *os.File).
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// EMPTY_READ_LIMIT is how many reads in a row may return no data and no
+// error before the connection is considered broken (CHANNEL_CLOSED). The
+// reads are retried with a growing delay of a few microseconds.
+var EMPTY_READ_LIMIT = 100
+
+// conn_read fills buffer from r. The timeout is only applied if r supports
+// read deadlines. EOF after the first byte is a truncated frame.
+// Reads that return nothing are retried, up to EMPTY_READ_LIMIT.
+func conn_read(r io.Reader, timeout time.Duration, buffer []byte) (int, error) {
+	return read_full(r, timeout, buffer, false)
+}
+
+// conn_read_rest is conn_read for the rest of a frame, after the header:
+// any EOF is a truncated frame.
+func conn_read_rest(r io.Reader, buffer []byte) (int, error) {
+	return read_full(r, time.Duration(0), buffer, true)
+}
+
+func read_full(r io.Reader, timeout time.Duration, buffer []byte, inFrame bool) (int, error) {
+	if conn, ok := r.(readDeadliner); ok {
+		if timeout != time.Duration(0) {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		} else {
+			// don't keep the deadline of a previous read
+			conn.SetReadDeadline(NO_DEADLINE)
+		}
 	}
 
 	position := 0
 	length := len(buffer)
 
+	empty := 0
 	for position < length {
-		bytesRead, err := conn.Read(buffer[position:])
-		if err != nil {
-			if err == io.EOF {
-				log.Println("conn_read", "CLOSED")
-				return 0, CHANNEL_CLOSED
-			} else if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				log.Println("conn_read", "TIMEOUT")
-				return 0, CHANNEL_TIMEOUT
+		bytesRead, err := r.Read(buffer[position:])
+		if err == io.EOF && (inFrame || position+bytesRead > 0) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil && bytesRead == 0 {
+			// allowed by io.Reader, but a reader that keeps doing it is broken
+			if empty++; empty >= EMPTY_READ_LIMIT {
+				err = io.ErrNoProgress
 			} else {
-				// we should do better than this
-				log.Println("conn_read", err)
-				return 0, CHANNEL_CLOSED
+				time.Sleep(time.Duration(empty) * time.Microsecond)
+				continue
 			}
+		}
+		if err != nil {
+			return 0, conn_error(err)
 		} else {
 			position += bytesRead
+			empty = 0
 		}
 	}
 
 	return position, nil
 }
 
-func (c *Multiplex) select_channel(timeout time.Duration, channelId uint) (uint, error) {
-	if c == nil {
-		return 0, CHANNEL_CLOSED
-	}
+func is_timeout(err error) bool {
+	neterr, ok := err.(net.Error)
+	return ok && neterr.Timeout()
+}
 
-	// Check if data is available somewhere
-	if channelId < c.max_channels {
-		if buf := c.channels[channelId]; buf != nil && buf.length > 0 && buf.newData != 0 {
-			buf.newData = 0
-			return channelId, nil
-		}
+func conn_error(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		log.Println("conn_read", "TRUNCATED")
+		return CHANNEL_TRUNCATED
+	} else if err == io.EOF {
+		log.Println("conn_read", "CLOSED")
+		return CHANNEL_CLOSED
+	} else if is_timeout(err) {
+		log.Println("conn_read", "TIMEOUT")
+		return CHANNEL_TIMEOUT
+	} else {
+		// we should do better than this
+		log.Println("conn_read", err)
+		return CHANNEL_CLOSED
 	}
+}
 
-	for i := 0; i < int(c.max_channels); i++ {
-		if buf := c.channels[i]; buf != nil && buf.length > 0 && buf.newData != 0 {
-			buf.newData = 0
-			return uint(i), nil
-		}
+// WithStrictEOF tells a connection that ends in the middle of a frame
+// (after the first byte of the header, or in the payload) from one that
+// is closed between frames: the read returns CHANNEL_TRUNCATED, that
+// matches io.ErrUnexpectedEOF, instead of CHANNEL_CLOSED, and then
+// CHANNEL_CLOSED as usual. The data received for the truncated frame is
+// dropped. Without it both are CHANNEL_CLOSED.
+func WithStrictEOF() Option {
+	return func(c *Multiplex) {
+		c.strict_eof = true
 	}
+}
 
-	//
-	var prefixBuffer [headerLength]byte
-	n, err := conn_read(c.conn, timeout, prefixBuffer[:])
-	if err != nil {
-		return 0, err
+// read_failed records that the connection is gone, if that's what err says.
+// A truncated frame is reported as such only with WithStrictEOF.
+func (c *Multiplex) read_failed(err error) error {
+	if err == CHANNEL_TRUNCATED && !c.strict_eof {
+		err = CHANNEL_CLOSED
 	}
-	if n != headerLength {
-		log.Println("expected", headerLength, "read", n)
-		return 0, CHANNEL_IGNORED
+	if err == CHANNEL_CLOSED || err == CHANNEL_TRUNCATED {
+		c.closed = true
+		c.peer_closed = true
+		c.broken.Store(true)
 	}
 
-	/*
-			if prefixBuffer[0] != magic {
-				log.Println("expected", magic, "got", prefixBuffer)
-		                return 0, CHANNEL_IGNORED
-			}
-	*/
-
-	//
-	dataLength := int(prefixBuffer[0])<<24 | int(prefixBuffer[1])<<16 | int(prefixBuffer[2])<<8 | int(prefixBuffer[3])<<0
-	channelId = uint(prefixBuffer[4])
+	return err
+}
 
-	buffer := make([]byte, dataLength-1)
-	start := 0
-	for start < dataLength-1 {
-		n, err = conn_read(c.conn, time.Duration(0), buffer[start:])
-		if err != nil {
-			return 0, err
-		}
-		if n == 0 {
-			log.Println("select_channel", "expected", len(buffer)-start, "got 0")
-		}
-		start += n
+// remaining returns the time left until deadline, or CHANNEL_TIMEOUT if it
+// expired. A zero timeout (no deadline) stays zero.
+func remaining(timeout time.Duration, deadline time.Time) (time.Duration, error) {
+	if timeout == time.Duration(0) {
+		return timeout, nil
 	}
 
-	if c.channels[channelId] == nil {
-		return channelId, CHANNEL_IGNORED
+	if timeout = time.Until(deadline); timeout <= 0 {
+		return 0, CHANNEL_TIMEOUT
 	}
-	c.write_channel(channelId, buffer)
-	return channelId, nil
-}
-
-func (c *Multiplex) Select(timeout time.Duration) (uint, error) {
-	c.Lock()
-	defer c.Unlock()
-
-	return c.select_channel(timeout, c.max_channels)
-}
 
-func (c *Multiplex) Ignore(channelId uint) {
-	c.Lock()
-	c.channels[channelId].newData = 0
-	c.Unlock()
+	return timeout, nil
 }
 
-func (c *Multiplex) receive_channel(timeout time.Duration, channelId uint, dst []byte) (int, error) {
+func (c *Multiplex) select_channel(timeout time.Duration, channelId uint) (uint, error) {
 	if c == nil {
 		return 0, CHANNEL_CLOSED
 	}
-
-	buf := c.channels[channelId]
-	if buf == nil {
-		return 0, CHANNEL_IGNORED
+	if c.direction == SEND_ONLY {
+		return 0, CHANNEL_DIRECTION
 	}
 
-	length := len(dst)
-
-	// Check if data is already buffered.
-	if buf.length > 0 {
-		if length >= buf.length {
-			length = buf.length
-		}
+	if selected, ok := c.buffered_channel(channelId); ok {
+		return selected, nil
+	}
 
-		copy(dst, buf.data[buf.offset:buf.offset+length])
-		buf.offset += length
-		buf.length -= length
-		return length, nil
+	if c.closed {
+		return 0, CHANNEL_CLOSED
 	}
 
-        receiveId, err := c.select_channel(timeout, channelId)
-        if err != nil {
-                return 0, err
-        }
+	if err := c.read_err; err != nil && !c.reader {
+		return 0, err
+	}
 
-        if receiveId != channelId {
-                return 0, CHANNEL_IGNORED
-        }
+	w := c.add_waiter("Select", channelId)
+	defer c.remove_waiter(w)
 
-	// Copy from ChannelBuffer
-	return c.read_channel(channelId, dst)
-}
+	if c.reader || c.reading {
+		// the background reader (or a Receive) owns the connection
+		return c.wait_channel(timeout, channelId, w)
+	}
 
-func (c *Multiplex) Receive(timeout time.Duration, channelId uint, data []byte) (int, error) {
-        for {
-	    c.Lock()
-	    n, err := c.receive_channel(timeout, channelId, data)
-            if err != CHANNEL_IGNORED {
-                c.Unlock()
-                return n, err
-            }
+	selected, err := c.read_unlocked(timeout, nil)
+	if w.cancelled {
+		return 0, CHANNEL_CANCELLED
+	}
+	if buf := c.channels[selected]; buf != nil && err == nil {
+		if buf.paused {
+			return selected, CHANNEL_IGNORED
+		}
 
-            c.Unlock()
-        }
+		// selected right away
+		buf.signaled = false
+	}
 
-        // unreachable
-        return 0, CHANNEL_IGNORED
+	return selected, err
 }
 
-// ----------------------------------------------------------------------
-//
-//   SEND LOGIC
-//
-// ----------------------------------------------------------------------
-func (c *Multiplex) Send(channelId uint, src []byte) (int, error) {
-	if len(src) == 0 {
-		return 0, nil
+// receive_next waits for the next frame for the given channel, without
+// selecting any channel. The frame is read without the lock (see
+// read_unlocked), and if it's for another channel it's buffered for its
+// owner (and CHANNEL_IGNORED is returned), that is woken up to take it.
+// While someone else (or the background reader) is reading the connection
+// it waits for a frame to be buffered for the channel instead.
+func (c *Multiplex) receive_next(timeout time.Duration, channelId uint) error {
+	if c.direction == SEND_ONLY {
+		return CHANNEL_DIRECTION
+	}
+	if c.closed {
+		return CHANNEL_CLOSED
+	}
+	if err := c.read_err; err != nil && !c.reader {
+		return err
 	}
 
-	c.Lock()
-	defer c.Unlock()
-
-	length := len(src) + 1
+	w := c.add_waiter("Receive", channelId)
+	defer c.remove_waiter(w)
 
-	buffer := []byte{
-		//magic,
-		(byte)((length >> 24) & 0xFF),
-		(byte)((length >> 16) & 0xFF),
-		(byte)((length >> 8) & 0xFF),
-		(byte)((length >> 0) & 0xFF),
-		(byte)(channelId & 0xFF)}
+	if c.reader || c.reading {
+		return c.wait_data(timeout, channelId, w)
+	}
 
-	buffer = append(buffer, src...)
+	receiveId, err := c.read_unlocked(timeout, nil)
+	if w.cancelled {
+		return CHANNEL_CANCELLED
+	}
+	if receiveId != channelId && dropped(err) {
+		// rejected for another channel
+		return CHANNEL_IGNORED
+	}
+	if err != nil {
+		return err
+	}
 
-	n, err := c.conn.Write(buffer)
-	if n != len(buffer) || err != nil {
-		log.Println("sent ", n, "expected", len(buffer), err)
-	} else {
-		n -= headerLength
+	if receiveId != channelId {
+		return CHANNEL_IGNORED
 	}
 
-	return n, err
+	return nil
+}
+
+// read_unlocked reads the next frame from the connection and buffers it.
+// It releases the lock while it waits on the connection, so that
+// concurrent Selects and Receives can wait for their frame (see
+// wait_channel and wait_data), with their own timeout, instead of queueing
+// on the lock and taking turns reading frames that belong to someone else.
+//
+// With a direct waiter (ReadAny), the frame read is handed to it instead of
+// being buffered, if its channel has nothing buffered (see write_channel).
+// Only the frame read here can be handed over: the data buffered by others
+// while the lock is released (i.e. Write, or the frames held for a channel
+// that is enabled) is not.
+func (c *Multiplex) read_unlocked(timeout time.Duration, direct *waiter) (uint, error) {
+	conn := c.conn
+	timeout = c.startup_timeout(timeout)
+	c.reading = true
+	c.Unlock()
+
+	channelId, control, data, scratch, err := c.read_frame(conn, timeout)
+
+	c.Lock()
+	c.reading = false
+	defer c.cond.Broadcast()
+
+	if err != nil {
+		if conn != c.conn {
+			// the connection was replaced
+			return 0, CHANNEL_IGNORED
+		}
+		if err == CHANNEL_TIMEOUT && c.startup_expired() {
+			return 0, CHANNEL_STARTUP_TIMEOUT
+		}
+		return 0, c.read_failed(err)
+	}
+
+	defer c.release_frame_buffer(scratch)
+
+	c.direct_to = direct
+	channelId, err = c.receive_frame(channelId, control, data)
+	c.direct_to = nil
+	c.channels[channelId].wipe(data)
+	if buf := c.channels[channelId]; buf != nil && err != CHANNEL_IGNORED && !dropped(err) && buf.newData == 0 && !buf.paused {
+		// a frame without data (empty or control), select it anyway
+		buf.signaled = true
+	}
+
+	return channelId, err
+}
+
+// buffered_channel returns a channel with data (or a frame) that wasn't
+// selected yet, giving precedence to the given channel.
+func (c *Multiplex) buffered_channel(channelId uint) (uint, bool) {
+	// Check if data is available somewhere
+	if channelId < c.max_channels {
+		if buf := c.channels[channelId]; buf != nil && buf.unselected() {
+			buf.selected()
+			return channelId, true
+		}
+	}
+
+	if c.active == 1 {
+		return c.single_channel()
+	}
+
+	// round robin, so that a channel that keeps receiving can't hide the
+	// others, and channels over their fair share only when nothing else
+	// is pending
+	if c.fair_share > 0 {
+		if i, ok := c.next_unselected(c.fair_share); ok {
+			return i, true
+		}
+	}
+	if i, ok := c.next_unselected(0); ok {
+		return i, true
+	}
+
+	if c.renotify > 0 {
+		// data that was selected (or ignored) but never consumed
+		for i := 0; i < int(c.max_channels); i++ {
+			if buf := c.channels[i]; buf != nil && buf.length > 0 && !buf.paused && time.Since(buf.lastSelected) >= c.renotify {
+				buf.selected()
+				return uint(i), true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// single_channel is buffered_channel when only one channel is enabled (a
+// single stream over the whole connection), that has nothing to scan for.
+func (c *Multiplex) single_channel() (uint, bool) {
+	buf := c.channels[c.single]
+	if buf.unselected() {
+		buf.selected()
+		c.select_next = c.single + 1
+		return c.single, true
+	}
+
+	if c.renotify > 0 && buf.length > 0 && !buf.paused && time.Since(buf.lastSelected) >= c.renotify {
+		buf.selected()
+		return c.single, true
+	}
+
+	return 0, false
+}
+
+// next_unselected returns the channel with new data with the highest
+// priority, the next one after the last selected among those with the same
+// priority, skipping the channels with more than limit bytes buffered (if
+// limit > 0).
+func (c *Multiplex) next_unselected(limit int) (uint, bool) {
+	var best *ChannelBuffer
+	var selected uint
+
+	for n := uint(0); n < c.max_channels; n++ {
+		i := (c.select_next + n) % c.max_channels
+		if buf := c.channels[i]; buf != nil && buf.unselected() && (limit <= 0 || buf.length <= limit) {
+			if best == nil || buf.priority > best.priority {
+				best = buf
+				selected = i
+			}
+			if !c.prioritized {
+				break
+			}
+		}
+	}
+
+	if best == nil {
+		return 0, false
+	}
+
+	best.selected()
+	c.select_next = selected + 1
+	return selected, true
+}
+
+// read_frame reads the next frame from conn. The frame data is in scratch,
+// that the caller must release once the frame is received.
+func (c *Multiplex) read_frame(conn net.Conn, timeout time.Duration) (uint, bool, []byte, *[]byte, error) {
+	if c.codec != nil {
+		return c.read_codec(conn, timeout)
+	}
+	if c.packet {
+		return c.read_packet(conn, timeout)
+	}
+	if c.read_buffer > 0 {
+		return c.read_buffered(conn, timeout)
+	}
+
+	return c.parse_frame(conn, timeout)
+}
+
+// parse_frame reads a frame with the built-in header from r, as read_frame
+// does. The timeout only applies to the header (see conn_read).
+func (c *Multiplex) parse_frame(r io.Reader, timeout time.Duration) (uint, bool, []byte, *[]byte, error) {
+	prefixBuffer := make([]byte, c.header_length())
+	if c.resync_hdr != nil && c.resync_from == r {
+		copy(prefixBuffer, c.resync_hdr)
+		c.resync_hdr, c.resync_from = nil, nil
+	} else {
+		n, err := conn_read(r, timeout, prefixBuffer)
+		if err != nil {
+			return 0, false, nil, nil, err
+		}
+		if n != len(prefixBuffer) {
+			log.Println("expected", len(prefixBuffer), "read", n)
+			c.count_ignored()
+			return 0, false, nil, nil, CHANNEL_IGNORED
+		}
+	}
+
+	//
+	dataLength, channelId, control, err := c.decode_header(prefixBuffer)
+	if err == CHANNEL_PROTOCOL && c.can_resync() {
+		return 0, false, nil, nil, c.resync_stream(r, prefixBuffer)
+	}
+	if err != nil {
+		return 0, false, nil, nil, err
+	}
+
+	scratch := c.frame_buffer(dataLength - 1)
+	buffer := *scratch
+	start := 0
+	for start < dataLength-1 {
+		n, err := conn_read_rest(r, buffer[start:])
+		if err != nil {
+			c.release_frame_buffer(scratch)
+			return 0, false, nil, nil, err
+		}
+		if n == 0 {
+			log.Println("read_frame", "expected", len(buffer)-start, "got 0")
+		}
+		start += n
+	}
+
+	return channelId, control, buffer, scratch, nil
+}
+
+func (c *Multiplex) receive_frame(channelId uint, control bool, data []byte) (uint, error) {
+	if channelId >= c.max_channels {
+		// the header has room for more channels than we have (see
+		// NewMultiplexEx): the peer doesn't agree on the channels
+		log.Println("receive_frame", "invalid channel", channelId, "max", c.max_channels)
+		return channelId, CHANNEL_PROTOCOL
+	}
+
+	c.started = true
+
+	var err error
+	if c.sequence && !control {
+		// check the sequence even for ignored frames, to keep counting
+		if data, err = c.check_sequence(channelId, data); err == CHANNEL_PROTOCOL {
+			return channelId, err
+		}
+	}
+
+	if !control {
+		c.totals.frames_received.Add(1)
+		c.totals.bytes_received.Add(uint64(len(data)))
+	}
+
+	if control && len(data) > 0 && data[0] == CONTROL_NACK {
+		return c.receive_nack(channelId)
+	}
+
+	if c.channels[channelId] == nil {
+		if !c.hold_frame(channelId, control, data) {
+			c.count_ignored()
+			if !control {
+				c.send_nack(channelId)
+			}
+		}
+		return channelId, CHANNEL_IGNORED
+	}
+
+	if control {
+		return c.receive_control(channelId, data)
+	}
+
+	buf := c.channels[channelId]
+	buf.stats.FramesReceived++
+	buf.stats.BytesReceived += uint64(len(data))
+
+	if limit := buf.max_message; limit > 0 && len(data) > limit {
+		log.Println("receive_frame", channelId, "frame too large", len(data))
+		return channelId, CHANNEL_FRAME_TOO_LARGE
+	}
+
+	if werr := c.write_channel(channelId, data); werr != nil {
+		return channelId, werr
+	}
+	return channelId, err
+}
+
+// dropped returns true if receive_frame returned err because the frame was
+// rejected for its channel, that other readers should ignore.
+func dropped(err error) bool {
+	return err == CHANNEL_FRAME_TOO_LARGE || err == CHANNEL_BUFFER_LIMIT
+}
+
+func (c *Multiplex) Select(timeout time.Duration) (uint, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	selected, err := c.select_channel(timeout, c.max_channels)
+	return selected, c.count_error(err)
+}
+
+// SelectData is like Select, but also returns a copy of the data buffered
+// for the selected channel and clears it, as Select, Dup and Clear would
+// do, under a single lock. The data is nil if the channel was selected
+// without buffered data (i.e. the peer closed it).
+func (c *Multiplex) SelectData(timeout time.Duration) (uint, []byte, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	selected, err := c.select_channel(timeout, c.max_channels)
+	if err != nil {
+		return selected, nil, c.count_error(err)
+	}
+
+	buf := c.channels[selected]
+	if buf == nil || buf.length == 0 {
+		return selected, nil, nil
+	}
+
+	data := append([]byte(nil), buf.data[buf.offset:buf.offset+buf.length]...)
+	c.clear_channel(selected)
+	return selected, data, nil
+}
+
+// SelectPending is like Select, but returns any channel with buffered data,
+// whether or not it was already selected: data that was selected but not
+// consumed is not stranded until more data arrives. It keeps returning the
+// same channel until its data is consumed (or cleared).
+func (c *Multiplex) SelectPending(timeout time.Duration) (uint, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.direction != SEND_ONLY {
+		for i := 0; i < int(c.max_channels); i++ {
+			if buf := c.channels[i]; buf != nil && buf.length > 0 && !buf.paused {
+				buf.selected()
+				return uint(i), nil
+			}
+		}
+	}
+
+	selected, err := c.select_channel(timeout, c.max_channels)
+	return selected, c.count_error(err)
+}
+
+// Ignore marks the data buffered for the channel as already selected:
+// Select doesn't return the channel again until more data arrives (or the
+// renotify interval expires, see SetRenotifyInterval), but the data can
+// still be read with Read, Receive, ReadFrame or Dup.
+func (c *Multiplex) Ignore(channelId uint) {
+	if c.lock_channel(channelId) {
+		c.channels[channelId].selected()
+		c.Unlock()
+	}
+}
+
+// Pause stops delivering the data received on the channel, without
+// disabling it: frames are still read and buffered, but Select doesn't
+// return the channel, and Receive, ReadFrame and Stream.Read wait, until
+// Resume is called. Unlike Ignore it lasts until Resume. Read, Dup and
+// friends still see the buffered data.
+func (c *Multiplex) Pause(channelId uint) {
+	if c.lock_channel(channelId) {
+		c.channels[channelId].paused = true
+		c.Unlock()
+	}
+}
+
+// Resume delivers again the data received on a paused channel: all the
+// data buffered so far is selected as new data.
+func (c *Multiplex) Resume(channelId uint) {
+	if c.lock_channel(channelId) {
+		buf := c.channels[channelId]
+		if buf.paused {
+			buf.paused = false
+			buf.newData = buf.length
+			c.cond.Broadcast()
+		}
+		c.Unlock()
+	}
+}
+
+// SetNonBlocking switches the channel between blocking reads (the default)
+// and non-blocking reads, as O_NONBLOCK does for a socket. In non-blocking
+// mode Receive, ReadFrame, Stream.Read and the channel Reader return the
+// buffered data, or CHANNEL_WOULDBLOCK right away if there is none
+// (CHANNEL_PAUSED if the channel is paused): they never read the connection or wait, so frames
+// must be read by someone else (Select, RunLoop or the background reader).
+// The end of the channel and of the connection are still reported. The mode
+// is reset when the channel is disabled. It returns CHANNEL_CLOSED if the
+// channel is not enabled.
+func (c *Multiplex) SetNonBlocking(channelId uint, on bool) error {
+	if channelId >= c.max_channels || !c.lock_channel(channelId) {
+		return CHANNEL_CLOSED
+	}
+
+	c.channels[channelId].nonblocking = on
+	c.Unlock()
+	return nil
+}
+
+// would_block is what a non-blocking read returns when there is nothing to
+// read.
+func (buf *ChannelBuffer) would_block() error {
+	if buf.paused {
+		return CHANNEL_PAUSED
+	}
+
+	return CHANNEL_WOULDBLOCK
+}
+
+// SetRenotifyInterval makes Select return again a channel whose buffered
+// data was selected (or ignored) but not consumed for at least interval,
+// so that data isn't stranded if the selecting goroutine didn't consume
+// it. Zero disables it (the default): a channel is only selected when new
+// data arrives.
+func (c *Multiplex) SetRenotifyInterval(interval time.Duration) {
+	c.Lock()
+	if interval < 0 {
+		interval = 0
+	}
+	c.renotify = interval
+	c.Unlock()
+}
+
+// SetReceivePriority sets the priority of the channel for Select: when
+// several channels have new data, the one with the highest priority is
+// returned first (channels with the same priority take turns), so that i.e.
+// a control channel isn't kept waiting behind bulk transfers. The default
+// priority is 0, and it can be negative. Channels over their fair share (see
+// SetFairShare) still go last. The priority is dropped when the channel is
+// disabled. It returns CHANNEL_CLOSED if the channel is not enabled.
+func (c *Multiplex) SetReceivePriority(channelId uint, priority int) error {
+	if channelId >= c.max_channels || !c.lock_channel(channelId) {
+		return CHANNEL_CLOSED
+	}
+
+	c.channels[channelId].priority = priority
+	if priority != 0 {
+		c.prioritized = true
+	}
+	c.Unlock()
+	return nil
+}
+
+// SetFairShare makes Select return the channels with more than maxBytes
+// buffered only when no other channel has new data, so that a peer flooding
+// one channel doesn't delay the others. Channels with new data are always
+// returned in turn (not by channel id), this only changes which ones go
+// first. Zero disables it (the default).
+//
+// Note that the frames of the greedy channel are still read and buffered:
+// there is no flow control to stop the peer from sending them. Use
+// SetTotalBufferLimit to bound that memory.
+func (c *Multiplex) SetFairShare(maxBytes int) error {
+	if maxBytes < 0 {
+		return INVALID_ARGUMENT
+	}
+
+	c.Lock()
+	c.fair_share = maxBytes
+	c.Unlock()
+	return nil
+}
+
+func (buf *ChannelBuffer) selected() {
+	buf.newData = 0
+	buf.signaled = false
+	buf.lastSelected = time.Now()
+}
+
+// unselected returns true if data (or a frame, see StartReader) was
+// received since the channel was last selected, and can be delivered.
+func (buf *ChannelBuffer) unselected() bool {
+	return !buf.paused && (buf.length > 0 && buf.newData != 0 || buf.signaled)
+}
+
+func (c *Multiplex) receive_channel(timeout time.Duration, channelId uint, dst []byte) (int, error) {
+	if c == nil {
+		return 0, CHANNEL_CLOSED
+	}
+	if c.direction == SEND_ONLY {
+		return 0, CHANNEL_DIRECTION
+	}
+
+	buf := c.channels[channelId]
+	if buf == nil {
+		return 0, CHANNEL_CLOSED
+	}
+
+	if buf.paused {
+		if buf.nonblocking && !c.closed {
+			return 0, CHANNEL_PAUSED
+		}
+
+		// wait for Resume (or the next frame), and try again
+		if err := c.receive_next(timeout, channelId); err != nil {
+			return 0, err
+		}
+		return 0, CHANNEL_IGNORED
+	}
+
+	// Check if data is already buffered. read_channel also consumes newData,
+	// so that Select doesn't report the data again.
+	if buf.length > 0 {
+		return c.read_channel(channelId, dst)
+	}
+
+	if buf.eof {
+		return 0, c.channel_eof(channelId)
+	}
+
+	if buf.nonblocking && !c.closed {
+		return 0, CHANNEL_WOULDBLOCK
+	}
+
+	if err := c.receive_next(timeout, channelId); err != nil {
+		return 0, err
+	}
+
+	// the lock was released while waiting
+	if buf = c.channels[channelId]; buf == nil {
+		return 0, CHANNEL_CLOSED
+	} else if buf.paused {
+		return 0, CHANNEL_IGNORED
+	}
+
+	// Copy from ChannelBuffer
+	n, err := c.read_channel(channelId, dst)
+	if n == 0 && err == nil && buf.eof {
+		return 0, c.channel_eof(channelId)
+	}
+
+	return n, err
+}
+
+// Receive copies the data buffered for the channel into data, or waits up
+// to timeout for a frame for the channel to arrive. Frames received for
+// other channels in the meantime are buffered (and left to be selected),
+// and a concurrent Receive waiting for them is woken up to take them.
+func (c *Multiplex) Receive(timeout time.Duration, channelId uint, data []byte) (int, error) {
+	var deadline time.Time
+	if timeout != time.Duration(0) {
+		deadline = time.Now().Add(timeout)
+	}
+
+	return c.ReceiveDeadline(deadline, channelId, data)
+}
+
+// ReceiveDeadline is like Receive, with an absolute deadline instead of a
+// timeout (i.e. from a context), that holds across the frames read for
+// other channels while waiting. A zero deadline waits forever. Data already
+// buffered is returned even if the deadline has passed, otherwise it
+// returns CHANNEL_TIMEOUT.
+func (c *Multiplex) ReceiveDeadline(deadline time.Time, channelId uint, data []byte) (int, error) {
+	for {
+		c.Lock()
+		n, err := c.receive_channel(deadline_timeout(deadline), channelId, data)
+		c.Unlock()
+
+		if err != CHANNEL_IGNORED {
+			return n, c.count_error(err)
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, c.count_error(CHANNEL_TIMEOUT)
+		}
+	}
+}
+
+// deadline_timeout returns the timeout left until deadline: zero (no
+// timeout) for a zero deadline, and negative (expire right away) once it
+// passed.
+func deadline_timeout(deadline time.Time) time.Duration {
+	if deadline.IsZero() {
+		return time.Duration(0)
+	}
+
+	if timeout := time.Until(deadline); timeout > 0 {
+		return timeout
+	}
+
+	return -1
+}
+
+// ----------------------------------------------------------------------
+//
+//   SEND LOGIC
+//
+// ----------------------------------------------------------------------
+func (c *Multiplex) send_channel(channelId uint, src []byte, deadline time.Time) (int, error) {
+	if len(src) == 0 {
+		return 0, nil
+	}
+
+	return c.send_frame(channelId, src, false, deadline)
+}
+
+// send_frame sends src as a frame on the given channel. A non-zero deadline
+// is applied to the connection for the duration of the write only, since
+// the connection is shared with the other channels.
+func (c *Multiplex) send_frame(channelId uint, src []byte, control bool, deadline time.Time) (int, error) {
+	if c.direction == RECV_ONLY {
+		return 0, c.count_error(CHANNEL_DIRECTION)
+	}
+
+	c.begin_write()
+	defer c.end_write()
+
+	if !deadline.IsZero() {
+		c.conn.SetWriteDeadline(deadline)
+		defer c.conn.SetWriteDeadline(NO_DEADLINE)
+	}
+
+	buffer := c.frame_prefix(channelId, len(src), len(src), control)
+	prefix := len(buffer)
+	buffer = append(buffer, src...)
+
+	if c.packet && len(buffer) > MAX_DATAGRAM_SIZE {
+		return 0, c.count_error(CHANNEL_FRAME_TOO_LARGE)
+	}
+
+	if err := c.writable(); err != nil {
+		return 0, c.count_error(err)
+	}
+	if !control {
+		if err := c.check_rejected(channelId); err != nil {
+			return 0, c.count_error(err)
+		}
+	}
+
+	if c.coalesce > 0 {
+		if err := c.reserve_queue(len(buffer)); err != nil {
+			return 0, c.count_error(err)
+		}
+
+		c.queue_frame(buffer)
+	} else if written, err := c.write_frame(buffer); err != nil {
+		if written < prefix {
+			return 0, c.count_error(err)
+		}
+
+		return written - prefix, c.count_error(err)
+	}
+
+	c.frame_sent(channelId, len(src), prefix > c.header_length())
+	return len(src), nil
+}
+
+// frame_prefix returns the header (and sequence number, if enabled) for a
+// frame with length bytes of payload, with room for room bytes of payload
+// (length, when the payload is appended to it).
+func (c *Multiplex) frame_prefix(channelId uint, length int, room int, control bool) []byte {
+	hl := c.header_length()
+	prefix := hl
+	if c.sequence && !control {
+		prefix += sequenceLength
+	}
+
+	buffer := make([]byte, prefix, prefix+room)
+	c.encode_header(buffer, channelId, prefix-hl+length+1, control)
+	if prefix > hl {
+		c.encode_sequence(buffer[hl:], channelId)
+	}
+
+	return buffer
+}
+
+// writable returns the error that prevents sending a frame, if any.
+func (c *Multiplex) writable() error {
+	if c.closed {
+		return CHANNEL_CLOSED
+	}
+	if c.desync {
+		return CHANNEL_DESYNC
+	}
+	if err := c.write_err; err != nil {
+		// a coalesced write failed
+		c.write_err = nil
+		return err
+	}
+
+	return nil
+}
+
+func (c *Multiplex) frame_sent(channelId uint, length int, sequence bool) {
+	c.totals.frames_sent.Add(1)
+	c.totals.bytes_sent.Add(uint64(length))
+
+	if sequence {
+		c.send_seq[channelId&0xFF]++
+	}
+	if channelId < MAX_CHANNELS && c.channels[channelId] != nil {
+		buf := c.channels[channelId]
+		buf.lastActivity = time.Now()
+		buf.stats.FramesSent++
+		buf.stats.BytesSent += uint64(length)
+	}
+}
+
+// begin_write waits until no other frame is being written and reserves the
+// connection, until end_write. Frames are written without holding the lock
+// (see write_unlocked), so that a write blocked on a slow peer doesn't stop
+// the received frames from being buffered (with a peer doing the same, the
+// two sides would wait for each other forever). The connection is reserved
+// before the frame is built, so that frames go out in sequence order.
+func (c *Multiplex) begin_write() {
+	for c.writing {
+		c.cond.Wait()
+	}
+
+	c.writing = true
+}
+
+func (c *Multiplex) end_write() {
+	c.writing = false
+	c.cond.Broadcast()
+}
+
+// write_unlocked calls write without holding the lock. The connection must
+// be reserved (see begin_write).
+func (c *Multiplex) write_unlocked(write func()) {
+	c.Unlock()
+	defer c.Lock()
+
+	write()
+}
+
+func (c *Multiplex) write_frame(buffer []byte) (int, error) {
+	// Keep writing until the whole frame is out: a partial frame on the wire
+	// would make the peer read the next frame header from the wrong place.
+	c.write_started()
+	defer c.write_done()
+
+	if c.codec != nil {
+		written, err := c.write_codec(buffer)
+		c.tap_sent([][]byte{buffer}, written)
+		return written, err
+	}
+
+	var err error
+	conn := c.conn
+	written := 0
+	retries := 0
+	for written < len(buffer) && err == nil {
+		var n int
+		c.write_unlocked(func() {
+			n, err = conn.Write(buffer[written:])
+		})
+		written += n
+
+		if err != nil && (n == 0 || !c.packet) && c.retry_write(retries, err) {
+			// a temporary error, write the rest of the frame
+			retries++
+			err = nil
+			continue
+		}
+
+		if err == nil && written < len(buffer) && (n == 0 || c.packet) {
+			err = io.ErrShortWrite
+		}
+	}
+
+	c.tap_sent([][]byte{buffer}, written)
+	if written == len(buffer) {
+		return written, nil
+	}
+
+	log.Println("sent ", written, "expected", len(buffer), err)
+	return written, c.write_failed(conn, written, err)
+}
+
+func (c *Multiplex) write_failed(conn net.Conn, written int, err error) error {
+	if conn != c.conn {
+		// the connection was replaced while writing, the frame is lost
+		return CHANNEL_CLOSED
+	}
+
+	if written > 0 && !c.packet {
+		c.desync = true
+		c.broken.Store(true)
+		err = CHANNEL_DESYNC
+	} else if written == 0 && !is_timeout(err) {
+		c.closed = true
+		c.broken.Store(true)
+		err = CHANNEL_CLOSED
+	}
+
+	return err
+}
+
+// Send writes src as a single frame on the given channel. Writes are
+// synchronous: when Send returns a nil error the full frame has been handed
+// to conn.Write (which doesn't mean it has left the OS send buffer), unless
+// write coalescing is enabled (see SetWriteCoalesce), in which case the
+// frame has only been queued.
+func (c *Multiplex) Send(channelId uint, src []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.send_channel(channelId, src, NO_DEADLINE)
+}
+
+// SendEmpty sends a frame with no payload on the given channel, that can be
+// used as a keepalive or an "end of message" marker. On the receiving side
+// Select returns the channel without any new buffered data and Receive
+// returns 0 bytes with a nil error.
+func (c *Multiplex) SendEmpty(channelId uint) error {
+	c.Lock()
+	defer c.Unlock()
+
+	_, err := c.send_frame(channelId, nil, false, NO_DEADLINE)
+	return err
+}
+
+// Flush returns once all the frames sent so far have been handed to the
+// connection. When Send writes synchronously there is nothing to drain and
+// Flush returns immediately, otherwise the queued frames are written.
+func (c *Multiplex) Flush() error {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.flush_frames()
 }
 
 // ----------------------------------------------------------------------
@@ -524,6 +1875,31 @@ func (c *Multiplex) Length(channelId uint) int {
 	return c.channels[channelId].length
 }
 
+// ChannelCapacity returns the size of the channel buffer, or -1 if the
+// channel is not enabled.
+func (c *Multiplex) ChannelCapacity(channelId uint) int {
+	if !c.lock_channel(channelId) {
+		return -1
+	}
+
+	defer c.Unlock()
+	return len(c.channels[channelId].data)
+}
+
+// ChannelFree returns how many bytes can be buffered for the channel
+// without moving or reallocating the buffered data, or -1 if the channel is
+// not enabled. Note that a buffer less than 25% full is still shrunk by the
+// next write (see reallocate_channel), even if the data would fit.
+func (c *Multiplex) ChannelFree(channelId uint) int {
+	if !c.lock_channel(channelId) {
+		return -1
+	}
+
+	defer c.Unlock()
+	buf := c.channels[channelId]
+	return len(buf.data) - (buf.offset + buf.length)
+}
+
 func (c *Multiplex) LastReceived(channelId uint) int {
 	if !c.lock_channel(channelId) {
 		return -1
@@ -548,3 +1924,105 @@ func (c *Multiplex) Dup(channelId uint) []byte {
 	buf := c.channels[channelId]
 	return append([]byte(nil), buf.data[buf.offset:buf.offset+buf.length]...)
 }
+
+// DupN is like Dup, but copies at most max bytes from the head of the
+// buffer. It returns nil if the channel is not enabled.
+func (c *Multiplex) DupN(channelId uint, max int) []byte {
+	if !c.lock_channel(channelId) {
+		return nil
+	}
+
+	defer c.Unlock()
+
+	buf := c.channels[channelId]
+	length := buf.length
+	if max < length {
+		length = max
+	}
+	if length < 0 {
+		length = 0
+	}
+
+	return append([]byte(nil), buf.data[buf.offset:buf.offset+length]...)
+}
+
+// Take returns the data buffered for the channel and empties the channel,
+// as Dup followed by Clear would, but without copying: the returned slice is
+// the channel buffer itself, that from then on is owned by the caller (the
+// multiplexer doesn't touch it anymore, even for a sensitive channel), and
+// the channel gets a new buffer of its initial size. It returns nil if the
+// channel is not enabled or has no data buffered.
+func (c *Multiplex) Take(channelId uint) []byte {
+	if !c.lock_channel(channelId) {
+		return nil
+	}
+
+	defer c.Unlock()
+
+	buf := c.channels[channelId]
+	if buf.length == 0 {
+		return nil
+	}
+
+	data := buf.data[buf.offset : buf.offset+buf.length]
+	c.buffer_total += buf.initial - len(buf.data)
+	buf.data = make([]byte, buf.initial)
+	buf.offset = 0
+	buf.length = 0
+	buf.newData = 0
+	buf.frames = buf.frames[:0]
+	return data
+}
+
+// Pending returns the buffered length of each channel that has data, taken
+// as a single snapshot. The map is freshly allocated on each call.
+func (c *Multiplex) Pending() map[uint]int {
+	c.Lock()
+	defer c.Unlock()
+
+	pending := make(map[uint]int)
+	for i := uint(0); i < c.max_channels; i++ {
+		if buf := c.channels[i]; buf != nil && buf.length > 0 {
+			pending[i] = buf.length
+		}
+	}
+
+	return pending
+}
+
+// Idle returns how long the channel has been quiet, that is the time since
+// data was last received, read or sent on it, or -1 if the channel is not
+// enabled.
+func (c *Multiplex) Idle(channelId uint) time.Duration {
+	if !c.lock_channel(channelId) {
+		return -1
+	}
+
+	defer c.Unlock()
+	return time.Since(c.channels[channelId].lastActivity)
+}
+
+// SetChannelContext attaches v (i.e. a session, a handler or a name) to
+// the channel, replacing the previous value. The value is dropped when the
+// channel is disabled. It returns CHANNEL_CLOSED if the channel is not
+// enabled.
+func (c *Multiplex) SetChannelContext(channelId uint, v interface{}) error {
+	if !c.lock_channel(channelId) {
+		return CHANNEL_CLOSED
+	}
+
+	c.channels[channelId].context = v
+	c.Unlock()
+	return nil
+}
+
+// ChannelContext returns the value attached to the channel with
+// SetChannelContext, or nil if there is none or the channel is not enabled.
+func (c *Multiplex) ChannelContext(channelId uint) interface{} {
+	if !c.lock_channel(channelId) {
+		return nil
+	}
+
+	defer c.Unlock()
+	return c.channels[channelId].context
+}
@@ -0,0 +1,107 @@
+package multiplex
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// ----------------------------------------------------------------------
+//
+//   PACKET MODE
+//
+// ----------------------------------------------------------------------
+// Over a datagram transport (UDP, unixgram) each datagram is a message,
+// so the in-order byte stream assumption doesn't hold: instead each
+// received datagram is treated as exactly one frame (header + payload).
+// This means frames must fit in one datagram (see MAX_DATAGRAM_SIZE).
+
+const (
+	MAX_DATAGRAM_SIZE = 65507 // maximum UDP payload over IPv4
+)
+
+// packetConn adapts a net.PacketConn to net.Conn, replying to the peer of
+// the last received datagram unless the PacketConn is already connected.
+type packetConn struct {
+	net.PacketConn
+	peer net.Addr
+}
+
+func (p *packetConn) Read(b []byte) (int, error) {
+	n, addr, err := p.ReadFrom(b)
+	if err == nil {
+		p.peer = addr
+	}
+
+	return n, err
+}
+
+func (p *packetConn) Write(b []byte) (int, error) {
+	if conn, ok := p.PacketConn.(net.Conn); ok && conn.RemoteAddr() != nil {
+		return conn.Write(b)
+	}
+
+	if p.peer == nil {
+		return 0, CHANNEL_CLOSED
+	}
+
+	return p.WriteTo(b, p.peer)
+}
+
+func (p *packetConn) RemoteAddr() net.Addr {
+	if conn, ok := p.PacketConn.(net.Conn); ok && conn.RemoteAddr() != nil {
+		return conn.RemoteAddr()
+	}
+
+	return p.peer
+}
+
+// NewMultiplexPacket creates a multiplexer over a datagram transport, where
+// each datagram carries exactly one frame. If pc is not connected, frames
+// are sent to the peer of the last received datagram.
+func NewMultiplexPacket(pc net.PacketConn, options ...Option) *Multiplex {
+	c := NewMultiplex(&packetConn{PacketConn: pc}, options...)
+	c.packet = true
+	return c
+}
+
+// read_packet reads the next datagram from conn, as read_frame does.
+func (c *Multiplex) read_packet(conn net.Conn, timeout time.Duration) (uint, bool, []byte, *[]byte, error) {
+	if timeout != time.Duration(0) {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		// don't keep the deadline of a previous read
+		conn.SetReadDeadline(NO_DEADLINE)
+	}
+
+	scratch := c.frame_buffer(MAX_DATAGRAM_SIZE)
+	datagram := *scratch
+
+	n, err := conn.Read(datagram)
+	if err != nil {
+		c.release_frame_buffer(scratch)
+		return 0, false, nil, nil, conn_error(err)
+	}
+	hl := c.header_length()
+	if n < hl {
+		log.Println("read_packet", "expected", hl, "read", n)
+		c.release_frame_buffer(scratch)
+		c.count_ignored()
+		return 0, false, nil, nil, CHANNEL_IGNORED
+	}
+
+	dataLength, channelId, control, err := c.decode_header(datagram[:hl])
+	if err != nil {
+		c.release_frame_buffer(scratch)
+		return 0, false, nil, nil, err
+	}
+
+	if dataLength-1 != n-hl {
+		log.Println("read_packet", "expected", dataLength-1, "got", n-hl)
+		c.release_frame_buffer(scratch)
+		c.count_ignored()
+		return 0, false, nil, nil, CHANNEL_IGNORED
+	}
+
+	return channelId, control, datagram[hl:n], scratch, nil
+}
@@ -0,0 +1,90 @@
+package multiplex
+
+// ----------------------------------------------------------------------
+//
+//   PIPE
+//
+// ----------------------------------------------------------------------
+
+// Pipe connects two multiplexers, forwarding each frame received on a
+// channel of one side to the mapped channel of the other side, until either
+// connection is closed. chanMap maps channels of a to channels of b (and is
+// inverted for the other direction); frames for unmapped channels are
+// dropped. A nil chanMap maps each channel to the same channel.
+//
+// When the peer closes a channel (see CloseWrite, CloseChannel) the close is
+// forwarded with the same code and the channel is disabled. When either
+// connection is closed the other one is closed as well. Pipe returns nil in
+// that case, or the error that stopped the forwarding.
+//
+// Pipe is the only one that can call Select on a and b while it runs.
+func Pipe(a, b *Multiplex, chanMap map[uint]uint) error {
+	var reverse map[uint]uint
+	if chanMap != nil {
+		reverse = make(map[uint]uint)
+		for from, to := range chanMap {
+			reverse[to] = from
+		}
+	}
+
+	result := make(chan error, 2)
+	go func() { result <- pipe_frames(a, b, chanMap) }()
+	go func() { result <- pipe_frames(b, a, reverse) }()
+
+	err := <-result
+	a.Close()
+	b.Close()
+	<-result
+
+	return err
+}
+
+func pipe_frames(from, to *Multiplex, mapping map[uint]uint) error {
+	for {
+		selected, err := from.Select(from.LoopInterval())
+		if err == CHANNEL_CLOSED {
+			return nil
+		} else if err == CHANNEL_PROTOCOL || err == CHANNEL_DIRECTION {
+			return err
+		} else if err != nil {
+			continue
+		}
+
+		target, mapped := selected, true
+		if mapping != nil {
+			target, mapped = mapping[selected]
+		}
+
+		// take all the buffered frames, so that boundaries are preserved
+		var frames [][]byte
+		var closed error
+
+		from.Lock()
+		for frame := from.next_frame(selected); frame != nil; frame = from.next_frame(selected) {
+			frames = append(frames, frame)
+		}
+		if buf := from.channels[selected]; buf != nil && buf.eof {
+			closed = buf.eof_error()
+			from.disable_channel(selected)
+		}
+		from.Unlock()
+
+		if !mapped {
+			continue
+		}
+
+		for _, frame := range frames {
+			if _, err := to.Send(target, frame); err == CHANNEL_CLOSED {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if closed == CHANNEL_EOF {
+			to.CloseWrite(target)
+		} else if cerr, ok := closed.(*CloseError); ok {
+			to.CloseChannel(target, cerr.Code, cerr.Message)
+		}
+	}
+}
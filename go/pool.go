@@ -0,0 +1,44 @@
+package multiplex
+
+import (
+	"sync"
+)
+
+// ----------------------------------------------------------------------
+//
+//   FRAME BUFFER POOL
+//
+// ----------------------------------------------------------------------
+// Each incoming frame is read into a scratch buffer and then copied into
+// the channel buffer (or consumed, for control frames), so the scratch
+// buffer is not needed once the frame has been received. With a frame
+// buffer pool the scratch buffers are taken from and returned to the pool,
+// instead of being allocated for each frame.
+
+// SetFrameBufferPool sets the pool of scratch buffers for incoming frames.
+// The pool must hold *[]byte values: a buffer that is too small for the
+// frame is dropped and a new one is allocated (and put in the pool after
+// use). Buffers are returned to the pool before Select returns, and their
+// content must not be relied on. Pass nil to allocate a buffer per frame
+// (the default).
+func (c *Multiplex) SetFrameBufferPool(pool *sync.Pool) {
+	c.frame_pool.Store(pool)
+}
+
+func (c *Multiplex) frame_buffer(size int) *[]byte {
+	if pool := c.frame_pool.Load(); pool != nil {
+		if scratch, ok := pool.Get().(*[]byte); ok && cap(*scratch) >= size {
+			*scratch = (*scratch)[:size]
+			return scratch
+		}
+	}
+
+	buffer := make([]byte, size)
+	return &buffer
+}
+
+func (c *Multiplex) release_frame_buffer(scratch *[]byte) {
+	if pool := c.frame_pool.Load(); pool != nil && scratch != nil {
+		pool.Put(scratch)
+	}
+}
@@ -0,0 +1,95 @@
+package multiplex
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+)
+
+// ----------------------------------------------------------------------
+//
+//   READ BUFFER
+//
+// ----------------------------------------------------------------------
+// By default each frame costs at least two reads from the connection, one
+// for the header and one for the payload, which makes small frames syscall
+// bound. With a read buffer the connection is read in large chunks, and
+// the frames are split out of the buffer, so that a single read usually
+// returns many small frames.
+//
+// The header is only consumed once it's complete: a read that times out in
+// the middle of a header leaves the partial header in the buffer, and the
+// next read resumes from it instead of losing the frame boundary.
+
+// WithReadBuffer reads the connection through a buffer of size bytes
+// (ignored for datagrams, see NewMultiplexPacket). The buffer is dropped
+// with the connection it was reading from (see ReplaceConn).
+func WithReadBuffer(size int) Option {
+	return func(c *Multiplex) {
+		if size > 0 {
+			c.read_buffer = size
+		}
+	}
+}
+
+// buffered_reader returns the read buffer for conn. It's only used by the
+// goroutine that owns the connection for reading (see read_unlocked and
+// read_loop), so it doesn't need the lock.
+func (c *Multiplex) buffered_reader(conn net.Conn) *bufio.Reader {
+	if c.rd == nil || c.rd_conn != conn {
+		c.rd = bufio.NewReaderSize(conn, c.read_buffer)
+		c.rd_conn = conn
+	}
+
+	return c.rd
+}
+
+// read_buffered is read_frame, through the read buffer.
+func (c *Multiplex) read_buffered(conn net.Conn, timeout time.Duration) (uint, bool, []byte, *[]byte, error) {
+	rd := c.buffered_reader(conn)
+	hl := c.header_length()
+
+	if rd.Buffered() < hl {
+		// we are going to block on the connection
+		if timeout != time.Duration(0) {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		} else {
+			conn.SetReadDeadline(NO_DEADLINE)
+		}
+	}
+
+	header, err := rd.Peek(hl)
+	if err == io.EOF && len(header) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, false, nil, nil, conn_error(err)
+	}
+
+	dataLength, channelId, control, err := c.decode_header(header)
+	if err == CHANNEL_PROTOCOL && c.can_resync() {
+		return 0, false, nil, nil, c.resync_buffered(rd)
+	}
+	rd.Discard(hl)
+	if err != nil {
+		return 0, false, nil, nil, err
+	}
+
+	scratch := c.frame_buffer(dataLength - 1)
+	if rd.Buffered() < dataLength-1 {
+		// the rest of the frame is not subject to the timeout
+		conn.SetReadDeadline(NO_DEADLINE)
+	}
+
+	if _, err := io.ReadFull(rd, *scratch); err != nil {
+		if err == io.EOF {
+			// after the header
+			err = io.ErrUnexpectedEOF
+		}
+		c.release_frame_buffer(scratch)
+		return 0, false, nil, nil, conn_error(err)
+	}
+
+	return channelId, control, *scratch, scratch, nil
+}
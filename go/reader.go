@@ -0,0 +1,219 @@
+package multiplex
+
+import (
+	"log"
+	"time"
+)
+
+// ----------------------------------------------------------------------
+//
+//   BACKGROUND READER
+//
+// ----------------------------------------------------------------------
+// By default whoever calls Select (or Receive, ReadFrame...) and finds no
+// buffered data reads the next frame from the connection, releasing the
+// lock while it waits on the connection (see read_unlocked). Concurrent
+// callers wait to be notified that a frame was buffered, and take over
+// reading the connection when the reader is done.
+//
+// With the background reader a single goroutine reads the frames, without
+// holding the lock while it waits on the connection, and buffers them for
+// their channel. Select and friends never read the connection: they only
+// look at the buffers, and wait to be notified when a frame is buffered.
+//
+// The reader only changes when the frames are read, not what the API
+// returns: Select still returns the ID of a channel with new data, Dup the
+// data buffered for it and Clear consumes it, and Receive and the Streams
+// work the same (example/test_compat.go runs the example flows both ways).
+// Since the frames are buffered before Select is called, a Select may find
+// more than one frame in the buffer, as it would without the reader when
+// called late. The frames the reader drops (for a disabled channel, or
+// over the limits) are counted (see ErrorCounts) instead of being returned
+// as CHANNEL_IGNORED or CHANNEL_FRAME_TOO_LARGE, since there is nobody
+// to return them to.
+
+// StartReader starts the background reader, that runs until the connection
+// is closed (it's one of the loops Wait waits for). Select, Receive and the
+// other functions keep working as before, but wait for the reader instead
+// of reading the connection, so RunLoop is not needed (but harmless).
+//
+// With the reader running, sequence gaps are logged but not reported, and
+// a protocol error stops the reader: it's returned by the pending and the
+// following Selects, until the connection is replaced (see ReplaceConn).
+// The reader keeps running across ReplaceConn, but not after it stopped:
+// call StartReader again.
+func (c *Multiplex) StartReader() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.direction == SEND_ONLY {
+		return CHANNEL_DIRECTION
+	}
+	if c.closed {
+		return CHANNEL_CLOSED
+	}
+	if c.reader {
+		// already running
+		return nil
+	}
+
+	c.reader = true
+	c.read_err = nil
+	c.loops.Add(1)
+	go c.read_loop()
+	return nil
+}
+
+func (c *Multiplex) read_loop() {
+	defer c.loops.Done()
+
+	c.Lock()
+	defer c.Unlock()
+
+	for !c.closed {
+		if c.reading {
+			// a Receive is still reading a frame (see read_unlocked)
+			c.cond.Wait()
+			continue
+		}
+
+		conn := c.conn
+		timeout := c.startup_timeout(time.Duration(0))
+		c.Unlock()
+
+		conn.SetReadDeadline(NO_DEADLINE)
+		channelId, control, data, scratch, err := c.read_frame(conn, timeout)
+
+		c.Lock()
+		if err != nil {
+			if conn == c.conn && err == CHANNEL_TIMEOUT && c.startup_expired() {
+				c.read_err = CHANNEL_STARTUP_TIMEOUT
+				break
+			}
+			if err == CHANNEL_RESYNC {
+				c.count_error(err)
+			}
+			if conn != c.conn || err == CHANNEL_IGNORED || err == CHANNEL_TIMEOUT || err == CHANNEL_RESYNC {
+				// the connection was replaced, a bad frame was skipped, or
+				// someone set a read deadline
+				continue
+			}
+
+			if c.read_failed(err) != CHANNEL_CLOSED {
+				c.read_err = err
+			}
+			break
+		}
+
+		channelId, err = c.receive_frame(channelId, control, data)
+		c.channels[channelId].wipe(data)
+		c.release_frame_buffer(scratch)
+
+		if err == CHANNEL_PROTOCOL {
+			c.read_err = err
+			break
+		}
+		if dropped(err) {
+			// nobody to return it to
+			c.count_error(err)
+		}
+		if buf := c.channels[channelId]; buf != nil && err != CHANNEL_IGNORED && !dropped(err) && buf.newData == 0 && !buf.paused {
+			// a frame without data (empty or control), select it anyway
+			buf.signaled = true
+		}
+
+		c.cond.Broadcast()
+	}
+
+	log.Println("read_loop", "stopped", c.read_err)
+	c.count_error(c.read_err)
+	c.reader = false
+	c.cond.Broadcast()
+}
+
+// wait_channel waits, up to timeout (forever if 0), for the reader to
+// buffer a frame, and returns the channel as select_channel does.
+func (c *Multiplex) wait_channel(timeout time.Duration, channelId uint, w *waiter) (uint, error) {
+	expired, stop := c.wait_timer(timeout)
+	defer stop()
+
+	for {
+		c.cond.Wait()
+
+		if w.cancelled {
+			return 0, CHANNEL_CANCELLED
+		}
+		if selected, ok := c.buffered_channel(channelId); ok {
+			return selected, nil
+		}
+		if err := c.wait_error(*expired); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// wait_data waits, up to timeout (forever if 0), for the reader (or a
+// Receive reading the connection) to buffer a frame for the given channel.
+// Frames for other channels don't wake it up for good, and are left to be
+// selected.
+func (c *Multiplex) wait_data(timeout time.Duration, channelId uint, w *waiter) error {
+	expired, stop := c.wait_timer(timeout)
+	defer stop()
+
+	for {
+		c.cond.Wait()
+
+		if w.cancelled {
+			return CHANNEL_CANCELLED
+		}
+
+		buf := c.channels[channelId]
+		if buf == nil {
+			return CHANNEL_CLOSED
+		}
+		if !buf.paused && (buf.length > 0 || buf.eof || buf.signaled) {
+			buf.signaled = false
+			return nil
+		}
+		if err := c.wait_error(*expired); err != nil {
+			return err
+		}
+	}
+}
+
+// wait_timer broadcasts after timeout (if not 0), setting expired.
+func (c *Multiplex) wait_timer(timeout time.Duration) (*bool, func() bool) {
+	expired := new(bool)
+	if timeout == time.Duration(0) {
+		return expired, func() bool { return false }
+	}
+
+	timer := time.AfterFunc(timeout, func() {
+		c.Lock()
+		*expired = true
+		c.cond.Broadcast()
+		c.Unlock()
+	})
+
+	return expired, timer.Stop
+}
+
+// wait_error returns why a wait for the reader should stop, if it should.
+// If nobody is reading the connection anymore (i.e. the Receive that was
+// reading timed out) it returns CHANNEL_IGNORED, to try again.
+func (c *Multiplex) wait_error(expired bool) error {
+	if c.closed {
+		return CHANNEL_CLOSED
+	}
+	if !c.reader && !c.reading {
+		if err := c.read_err; err != nil {
+			return err
+		}
+		return CHANNEL_IGNORED
+	}
+	if expired {
+		return CHANNEL_TIMEOUT
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package multiplex
+
+import (
+	"sort"
+)
+
+// ----------------------------------------------------------------------
+//
+//   REASSEMBLY
+//
+// ----------------------------------------------------------------------
+// The channel buffer is a byte stream that grows at the end, in the order
+// the frames arrive. A channel in positional mode is fed with WriteAt
+// instead, by a caller that gets the fragments of its messages out of
+// order from another transport: each fragment carries its offset in the
+// stream, the fragments past the first missing byte are held aside, and
+// only the contiguous data from the start is buffered, and so seen by
+// Select, Read and the rest of the API.
+
+var (
+	REASSEMBLY_LIMIT = 1024 * 1024 // bytes held out of order per positional channel
+)
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+// SetPositional switches the channel to positional mode (see WriteAt), with
+// offset 0 at the first byte written after the switch. Switching it off
+// drops the data held out of order. It returns CHANNEL_CLOSED if the
+// channel is not enabled. Disabling the channel resets the mode.
+func (c *Multiplex) SetPositional(channelId uint, on bool) error {
+	if channelId >= c.max_channels || !c.lock_channel(channelId) {
+		return CHANNEL_CLOSED
+	}
+
+	buf := c.channels[channelId]
+	buf.positional = on
+	buf.next_offset = 0
+	buf.fragments = nil
+	buf.held = 0
+	c.Unlock()
+	return nil
+}
+
+// WriteAt places data at offset in the stream of a positional channel. Data
+// at the end of the contiguous part is buffered (as Write does) together
+// with the fragments it connects; data past it is held until the gap is
+// filled, up to REASSEMBLY_LIMIT bytes (CHANNEL_BUFFER_LIMIT past that).
+// Bytes that were already written are ignored, so fragments can overlap or
+// be repeated. The channel is meant to be fed by WriteAt only: frames
+// received from the connection for it are appended as usual, outside of
+// the offsets.
+//
+// It returns CHANNEL_CLOSED if the channel is not enabled, and
+// INVALID_ARGUMENT if it's not positional or offset is negative. An error
+// buffering the data (see write_channel) is returned as is, and the data
+// is dropped.
+func (c *Multiplex) WriteAt(channelId uint, data []byte, offset int) error {
+	if offset < 0 {
+		return INVALID_ARGUMENT
+	}
+	if channelId >= c.max_channels || !c.lock_channel(channelId) {
+		return CHANNEL_CLOSED
+	}
+
+	defer c.Unlock()
+
+	buf := c.channels[channelId]
+	if !buf.positional {
+		return INVALID_ARGUMENT
+	}
+
+	if offset+len(data) <= buf.next_offset {
+		// nothing new
+		return nil
+	}
+
+	if offset > buf.next_offset {
+		if buf.held+len(data) > REASSEMBLY_LIMIT {
+			return c.count_error(CHANNEL_BUFFER_LIMIT)
+		}
+
+		i := sort.Search(len(buf.fragments), func(i int) bool { return buf.fragments[i].offset > offset })
+		buf.fragments = append(buf.fragments, fragment{})
+		copy(buf.fragments[i+1:], buf.fragments[i:])
+		buf.fragments[i] = fragment{offset: offset, data: append([]byte(nil), data...)}
+		buf.held += len(data)
+		return nil
+	}
+
+	err := c.append_at(channelId, data[buf.next_offset-offset:])
+	for err == nil && len(buf.fragments) > 0 && buf.fragments[0].offset <= buf.next_offset {
+		f := buf.fragments[0]
+		buf.fragments = buf.fragments[1:]
+		buf.held -= len(f.data)
+
+		if f.offset+len(f.data) > buf.next_offset {
+			err = c.append_at(channelId, f.data[buf.next_offset-f.offset:])
+		}
+	}
+
+	c.cond.Broadcast()
+	return c.count_error(err)
+}
+
+// append_at buffers the contiguous data of a positional channel.
+func (c *Multiplex) append_at(channelId uint, data []byte) error {
+	if err := c.write_channel(channelId, data); err != nil {
+		return err
+	}
+
+	c.channels[channelId].next_offset += len(data)
+	return nil
+}
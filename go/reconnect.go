@@ -0,0 +1,143 @@
+package multiplex
+
+import (
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+var (
+	RECONNECT_RETRIES = 5                      // default number of dial attempts per reconnect
+	RECONNECT_BACKOFF = 100 * time.Millisecond // default delay after the first failed attempt, doubled on each retry
+)
+
+/*
+ * ReconnectingStream is a Stream that survives transport drops: when the
+ * connection fails it dials a new one, swaps it in with ReplaceConn and
+ * retries the operation. A connection closed with Close is not reconnected.
+ *
+ * Data in flight when the connection dropped (partially received frames,
+ * frames not yet handed to the old connection) is lost; data that was
+ * already buffered for the channel is still delivered.
+ */
+type ReconnectingStream struct {
+	*Stream
+
+	Dial        func() (net.Conn, error) // creates the replacement connection
+	OnReconnect func(m *Multiplex)       // called after a reconnect, i.e. to restart RunLoop
+	Retries     int                      // dial attempts per reconnect
+	Backoff     time.Duration            // delay after the first failed attempt
+}
+
+func NewReconnectingStream(m *Multiplex, channelId uint, dial func() (net.Conn, error)) *ReconnectingStream {
+	s := NewStream(m, channelId)
+	if s == nil {
+		return nil
+	}
+
+	return &ReconnectingStream{Stream: s, Dial: dial, Retries: RECONNECT_RETRIES, Backoff: RECONNECT_BACKOFF}
+}
+
+func (r *ReconnectingStream) Read(b []byte) (int, error) {
+	for {
+		n, err := r.Stream.Read(b)
+		if err == io.EOF && r.Healthy() {
+			// the peer closed the channel, not the connection
+			return n, err
+		}
+		if (err != CHANNEL_CLOSED && err != io.EOF) || r.reconnect() != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *ReconnectingStream) Write(b []byte) (int, error) {
+	for {
+		n, err := r.Stream.Write(b)
+		if (err != CHANNEL_CLOSED && err != CHANNEL_DESYNC) || r.reconnect() != nil {
+			return n, err
+		}
+	}
+}
+
+// reconnect replaces the connection if it's gone. It returns CHANNEL_CLOSED
+// if the connection is fine (the channel was disabled instead) or was
+// closed with Close, or the dial error if all the attempts failed.
+//
+// The Multiplex is not locked while dialing and backing off, so the other
+// streams (and Close) are not blocked: the streams sharing the connection
+// may dial at the same time, and only the first one to get a connection
+// replaces the broken one.
+func (r *ReconnectingStream) reconnect() error {
+	m := r.Multiplex
+
+	m.Lock()
+	if m.shutdown {
+		// closed on purpose, don't bring it back
+		m.Unlock()
+		return CHANNEL_CLOSED
+	}
+
+	if !m.closed && !m.desync {
+		defer m.Unlock()
+
+		if m.channels[r.Channel()] == nil {
+			return CHANNEL_CLOSED
+		}
+
+		return nil // someone else reconnected already
+	}
+
+	broken := m.conn
+	m.Unlock()
+
+	delay := r.Backoff
+	for attempt := 1; ; attempt++ {
+		conn, err := r.Dial()
+		if err == nil {
+			m.Lock()
+			if m.shutdown || m.conn != broken {
+				// closed, or someone else reconnected in the meantime
+				shutdown := m.shutdown
+				m.Unlock()
+				conn.Close()
+
+				if shutdown {
+					return CHANNEL_CLOSED
+				}
+				return nil
+			}
+
+			old := m.replace_conn(conn)
+			m.enable_channel(r.Channel(), 0)
+			m.Unlock()
+
+			if old != nil {
+				old.Close()
+			}
+			break
+		}
+
+		log.Println("ReconnectingStream", r.Channel(), "attempt", attempt, err)
+		if attempt >= r.Retries {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+
+		m.Lock()
+		shutdown := m.shutdown
+		m.Unlock()
+		if shutdown {
+			return CHANNEL_CLOSED
+		}
+	}
+
+	if r.OnReconnect != nil {
+		r.OnReconnect(m)
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package multiplex
+
+import (
+	"time"
+)
+
+// ----------------------------------------------------------------------
+//
+//   POOLED RECEIVE BUFFERS
+//
+// ----------------------------------------------------------------------
+// Receive copies into a slice owned by the caller, who has to size it for
+// the largest message. ReceiveBuf returns the data in a Buffer whose
+// storage is taken from a free list instead, sized by the data received so
+// far, so that a receive loop that releases its buffers only allocates the
+// small Buffer handle once it reached its steady state.
+
+const RECV_FREE_BUFFERS = 16 // released buffers kept for reuse by ReceiveBuf
+
+// A Buffer holds the data returned by ReceiveBuf. It belongs to the caller
+// until Release, that gives its storage back to the Multiplex for a later
+// ReceiveBuf: after that the slices returned by Bytes may not be used,
+// since they will hold other data. A Buffer that is not released is simply
+// collected.
+type Buffer struct {
+	data      []byte
+	owner     *Multiplex
+	sensitive bool // zeroed on Release (see SetSensitive)
+	released  bool // under the owner's lock
+}
+
+// Bytes returns the data, valid until Release (nil after it).
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+// Len returns the length of the data.
+func (b *Buffer) Len() int {
+	return len(b.data)
+}
+
+// Release returns the buffer storage for reuse. Each ReceiveBuf returns a
+// new Buffer, so releasing one twice (even concurrently) does nothing the
+// second time, and never releases the storage of another Buffer. If the
+// channel was sensitive when the data was received (see SetSensitive and
+// WithZeroOnClear) the data is zeroed too.
+func (b *Buffer) Release() {
+	c := b.owner
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if b.released {
+		return
+	}
+
+	if b.sensitive || c.zero_on_clear {
+		data := b.data[:cap(b.data)]
+		for i := range data {
+			data[i] = 0
+		}
+	}
+
+	b.released = true
+	c.recycle(b.data)
+	b.data = nil
+}
+
+// ReceiveBuf is like Receive, but returns all the data buffered for the
+// channel in a Buffer, that the caller must Release when done with it (see
+// Buffer). On error the Buffer is nil.
+func (c *Multiplex) ReceiveBuf(timeout time.Duration, channelId uint) (*Buffer, error) {
+	var deadline time.Time
+	if timeout != time.Duration(0) {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		c.Lock()
+		// the lock may be released while waiting: the channel is sensitive
+		// if it was at any point
+		sensitive := c.is_sensitive(channelId)
+		data := c.recv_buffer()
+		n, err := c.receive_channel(deadline_timeout(deadline), channelId, data[:cap(data)])
+		if err != nil {
+			c.recycle(data)
+			c.Unlock()
+		} else {
+			data = c.read_rest(channelId, data[:n])
+			if len(data) > c.recv_size {
+				c.recv_size = len(data)
+			}
+			sensitive = sensitive || c.is_sensitive(channelId)
+			c.Unlock()
+			return &Buffer{data: data, owner: c, sensitive: sensitive}, nil
+		}
+
+		if err != CHANNEL_IGNORED {
+			return nil, c.count_error(err)
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, c.count_error(CHANNEL_TIMEOUT)
+		}
+	}
+}
+
+// recv_buffer returns released storage, or new storage as large as the
+// largest data returned so far.
+func (c *Multiplex) recv_buffer() []byte {
+	if n := len(c.recv_free); n > 0 {
+		data := c.recv_free[n-1]
+		c.recv_free[n-1] = nil
+		c.recv_free = c.recv_free[:n-1]
+		return data[:0]
+	}
+
+	size := c.recv_size
+	if size < INITIAL_BUFFER_SIZE {
+		size = INITIAL_BUFFER_SIZE
+	}
+
+	return make([]byte, 0, size)
+}
+
+// recycle keeps data for reuse, if there is room.
+func (c *Multiplex) recycle(data []byte) {
+	if len(c.recv_free) < RECV_FREE_BUFFERS {
+		c.recv_free = append(c.recv_free, data)
+	}
+}
+
+// read_rest appends to data the data still buffered for the channel, that
+// didn't fit.
+func (c *Multiplex) read_rest(channelId uint, data []byte) []byte {
+	buf := c.channels[channelId]
+	if buf == nil || buf.length == 0 || len(data) < cap(data) {
+		return data
+	}
+
+	n := len(data)
+	grown := make([]byte, n+buf.length)
+	copy(grown, data)
+	buf.wipe(data)
+	c.read_channel(channelId, grown[n:])
+	return grown
+}
+
+// is_sensitive returns whether the channel data is zeroed once consumed.
+func (c *Multiplex) is_sensitive(channelId uint) bool {
+	if channelId >= c.max_channels {
+		return false
+	}
+
+	buf := c.channels[channelId]
+	return buf != nil && buf.sensitive
+}
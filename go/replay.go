@@ -0,0 +1,92 @@
+package multiplex
+
+import (
+	"io"
+)
+
+// ----------------------------------------------------------------------
+//
+//   REPLAY
+//
+// ----------------------------------------------------------------------
+// ReadFrom feeds the multiplexer frames from any reader instead of the
+// connection, i.e. to process a captured frame stream offline, or to check
+// the parser against recorded traffic. The frames are parsed as read_frame
+// does and received as if they came from the peer.
+
+// countingReader counts the bytes read from r, and keeps its last error.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n += int64(n)
+	if err != nil {
+		cr.err = err
+	}
+
+	return n, err
+}
+
+// ReadFrom reads frames with the built-in header (as set by WithVersion or
+// WithMagicHeader, not a codec or datagrams) from r until io.EOF, and
+// buffers them into their channels as Select would: frames for disabled
+// channels are held or dropped, control frames are processed, and the
+// per-channel limits (see SetChannelMaxMessage and SetTotalBufferLimit)
+// apply, a dropped frame being counted but not stopping the replay. The
+// connection is not used, and Select, Receive and friends see the frames
+// as usual.
+//
+// It returns the number of bytes consumed from r, and a nil error if r
+// ended on a frame boundary. A stream cut in the middle of a frame returns
+// io.ErrUnexpectedEOF, and an invalid header CHANNEL_PROTOCOL (or
+// CHANNEL_VERSION).
+func (c *Multiplex) ReadFrom(r io.Reader) (int64, error) {
+	if c.direction == SEND_ONLY {
+		return 0, CHANNEL_DIRECTION
+	}
+
+	cr := &countingReader{r: r}
+	for {
+		frameStart := cr.n
+		channelId, control, data, scratch, err := c.parse_frame(cr, 0)
+		if err == CHANNEL_RESYNC {
+			c.count_error(err)
+			continue
+		}
+		if err != nil {
+			if cr.err == nil {
+				// a bad header
+				return cr.n, c.count_error(err)
+			}
+			if cr.err != io.EOF {
+				return cr.n, cr.err
+			}
+			if cr.n != frameStart {
+				return cr.n, io.ErrUnexpectedEOF
+			}
+			return cr.n, nil
+		}
+
+		c.Lock()
+		channelId, err = c.receive_frame(channelId, control, data)
+		c.channels[channelId].wipe(data)
+		if buf := c.channels[channelId]; buf != nil && err != CHANNEL_IGNORED && !dropped(err) && buf.newData == 0 && !buf.paused {
+			// a frame without data (empty or control), select it anyway
+			buf.signaled = true
+		}
+		c.cond.Broadcast()
+		c.Unlock()
+		c.release_frame_buffer(scratch)
+
+		if err == CHANNEL_PROTOCOL {
+			return cr.n, c.count_error(err)
+		}
+		if dropped(err) {
+			c.count_error(err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package multiplex
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+var (
+	WRITE_RETRIES = 3                     // default number of retries of a write that failed with a temporary error
+	WRITE_BACKOFF = 10 * time.Millisecond // default delay before the first retry, doubled on each retry
+)
+
+// SetWriteRetry sets how many times a frame write that failed with a
+// temporary error (a net.Error whose Temporary method returns true, i.e.
+// EAGAIN on a busy socket) is retried, resuming from the bytes that were
+// not written, and the delay before the first retry (doubled on each
+// retry). Timeouts and permanent errors are never retried. Zero retries
+// disables it. The lock is held while waiting.
+func (c *Multiplex) SetWriteRetry(retries int, backoff time.Duration) error {
+	if retries < 0 || backoff < 0 {
+		return INVALID_ARGUMENT
+	}
+
+	c.Lock()
+	c.write_retries = retries
+	c.write_backoff = backoff
+	c.Unlock()
+	return nil
+}
+
+func is_temporary(err error) bool {
+	neterr, ok := err.(net.Error)
+	return ok && !neterr.Timeout() && neterr.Temporary()
+}
+
+// retry_write returns true, after waiting, if a write that failed with err
+// should be retried. attempt is the number of retries already done.
+func (c *Multiplex) retry_write(attempt int, err error) bool {
+	if attempt >= c.write_retries || !is_temporary(err) {
+		return false
+	}
+
+	log.Println("write", "retry", attempt+1, err)
+	time.Sleep(c.write_backoff << attempt)
+	return true
+}
@@ -0,0 +1,147 @@
+package multiplex
+
+import (
+	"io"
+	"os"
+)
+
+// ----------------------------------------------------------------------
+//
+//   SEND FILE
+//
+// ----------------------------------------------------------------------
+// A file is sent as a sequence of frames of (up to) chunkSize bytes. When
+// the connection implements io.ReaderFrom (e.g. *net.TCPConn) each frame
+// header is written first and the payload is copied straight from the
+// file, so that the OS can use sendfile instead of copying the data
+// through user space.
+
+var (
+	SEND_FILE_CHUNK = 64 * 1024 // default chunk size for SendFile
+)
+
+// SendFile sends the content of f, from its current offset to the end, on
+// the given channel, as frames of up to chunkSize bytes (SEND_FILE_CHUNK if
+// chunkSize <= 0). It returns the number of bytes of f that were sent.
+//
+// The lock is only held while sending each chunk, so other channels can
+// send in between. The file shouldn't be truncated while being sent: a
+// short copy in the zero-copy path leaves a partial frame on the wire (see
+// CHANNEL_DESYNC).
+func (c *Multiplex) SendFile(channelId uint, f *os.File, chunkSize int) (int64, error) {
+	if chunkSize <= 0 {
+		chunkSize = SEND_FILE_CHUNK
+	}
+
+	remaining := int64(-1)
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		if offset, err := f.Seek(0, io.SeekCurrent); err == nil {
+			remaining = info.Size() - offset
+		}
+	}
+
+	var buffer []byte
+	total := int64(0)
+
+	for remaining != 0 {
+		if remaining > 0 {
+			n := int64(chunkSize)
+			if n > remaining {
+				n = remaining
+			}
+
+			sent, err := c.send_file_chunk(channelId, f, n)
+			total += sent
+			remaining -= sent
+			if err != nil {
+				return total, err
+			}
+
+			continue
+		}
+
+		if buffer == nil {
+			buffer = make([]byte, chunkSize)
+		}
+
+		n, err := f.Read(buffer)
+		if n > 0 {
+			sent, serr := c.Send(channelId, buffer[:n])
+			total += int64(sent)
+			if remaining > 0 {
+				remaining -= int64(sent)
+			}
+			if serr != nil {
+				return total, serr
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// send_file_chunk sends the next length bytes of f as a single frame. If
+// possible it writes the header and then copies the payload with the
+// connection ReadFrom.
+func (c *Multiplex) send_file_chunk(channelId uint, f *os.File, length int64) (int64, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.direction == RECV_ONLY {
+		return 0, c.count_error(CHANNEL_DIRECTION)
+	}
+
+	rf, ok := c.conn.(io.ReaderFrom)
+	if !ok || c.packet || c.coalesce > 0 || c.codec != nil || c.send_tap != nil {
+		// frames must be written as a whole
+		buffer := make([]byte, length)
+		n, err := io.ReadFull(f, buffer)
+		if err != nil {
+			return 0, err
+		}
+
+		sent, err := c.send_channel(channelId, buffer[:n], NO_DEADLINE)
+		return int64(sent), err
+	}
+
+	c.begin_write()
+	defer c.end_write()
+
+	if err := c.writable(); err != nil {
+		return 0, c.count_error(err)
+	}
+	if err := c.check_rejected(channelId); err != nil {
+		return 0, c.count_error(err)
+	}
+
+	conn := c.conn
+	header := c.frame_prefix(channelId, int(length), 0, false)
+	if _, err := c.write_frame(header); err != nil {
+		return 0, c.count_error(err)
+	}
+
+	var copied int64
+	var err error
+	c.write_started()
+	c.write_unlocked(func() {
+		copied, err = rf.ReadFrom(io.LimitReader(f, length))
+	})
+	c.write_done()
+
+	if err == nil && copied < length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		// the header is already out, so this is a partial frame
+		return copied, c.count_error(c.write_failed(conn, len(header)+int(copied), err))
+	}
+
+	c.frame_sent(channelId, int(copied), len(header) > c.header_length())
+	return copied, nil
+}
@@ -0,0 +1,48 @@
+package multiplex
+
+// ----------------------------------------------------------------------
+//
+//   SENSITIVE CHANNELS
+//
+// ----------------------------------------------------------------------
+// Consuming or clearing buffered data only moves the buffer offsets, so the
+// bytes stay in memory until they are overwritten by the next frames or the
+// buffer is collected. For channels carrying secrets (tokens, keys) the
+// data can be zeroed as soon as it's consumed instead.
+//
+// This covers the channel buffer and the scratch buffer the frame was read
+// into (see SetFrameBufferPool), not the connection read buffer (see
+// WithReadBuffer) nor the copies returned to the caller.
+
+// WithZeroOnClear makes every channel sensitive (see SetSensitive) when it's
+// enabled.
+func WithZeroOnClear() Option {
+	return func(c *Multiplex) {
+		c.zero_on_clear = true
+	}
+}
+
+// SetSensitive sets whether the data of the channel is zeroed once it's
+// consumed (by Read, Receive, ReadFrame or Stream.Read), discarded (by
+// Clear or Disable) or moved (when the buffer is compacted or
+// reallocated). It costs an extra pass over each byte received, that is
+// usually small compared to the copies the data goes through. It returns
+// CHANNEL_CLOSED if the channel is not enabled.
+func (c *Multiplex) SetSensitive(channelId uint, on bool) error {
+	if channelId >= c.max_channels || !c.lock_channel(channelId) {
+		return CHANNEL_CLOSED
+	}
+
+	c.channels[channelId].sensitive = on
+	c.Unlock()
+	return nil
+}
+
+// wipe zeroes b if the channel buffer is sensitive.
+func (buf *ChannelBuffer) wipe(b []byte) {
+	if buf != nil && buf.sensitive {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package multiplex
+
+import (
+	"fmt"
+	"log"
+)
+
+// ----------------------------------------------------------------------
+//
+//   SEQUENCE NUMBERS
+//
+// ----------------------------------------------------------------------
+// The protocol assumes in-order, lossless delivery. As a diagnostic, data
+// frames can carry a 4 byte per-channel sequence number at the start of
+// the payload, so that dropped or reordered frames are detected instead of
+// silently processed. Nothing is retransmitted: this is not a reliability
+// layer.
+
+const (
+	sequenceLength = 4
+)
+
+// A SequenceError is returned by Select (and Receive) when a frame arrives
+// with an unexpected sequence number. The frame data is still buffered, and
+// the following frames are checked against the received sequence number.
+type SequenceError struct {
+	Channel  uint
+	Expected uint32
+	Received uint32
+}
+
+func (e *SequenceError) Error() string {
+	return fmt.Sprintf("%s on channel %d: expected %d, received %d", CHANNEL_SEQUENCE.Error(), e.Channel, e.Expected, e.Received)
+}
+
+func (e *SequenceError) Unwrap() error {
+	return CHANNEL_SEQUENCE
+}
+
+// WithSequenceNumbers enables per-channel sequence numbers on data frames,
+// which both ends must enable.
+func WithSequenceNumbers() Option {
+	return func(c *Multiplex) {
+		c.sequence = true
+	}
+}
+
+func (c *Multiplex) encode_sequence(b []byte, channelId uint) {
+	seq := c.send_seq[channelId&0xFF]
+
+	b[0] = (byte)((seq >> 24) & 0xFF)
+	b[1] = (byte)((seq >> 16) & 0xFF)
+	b[2] = (byte)((seq >> 8) & 0xFF)
+	b[3] = (byte)((seq >> 0) & 0xFF)
+}
+
+// check_sequence strips the sequence number from data, and returns a
+// SequenceError if it's not the expected one.
+func (c *Multiplex) check_sequence(channelId uint, data []byte) ([]byte, error) {
+	if len(data) < sequenceLength {
+		log.Println("check_sequence", channelId, "missing sequence number")
+		return nil, CHANNEL_PROTOCOL
+	}
+
+	seq := uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])<<0
+	expected := c.recv_seq[channelId]
+	c.recv_seq[channelId] = seq + 1
+
+	if seq != expected {
+		log.Println("check_sequence", channelId, "expected", expected, "received", seq)
+		return data[sequenceLength:], &SequenceError{channelId, expected, seq}
+	}
+
+	return data[sequenceLength:], nil
+}
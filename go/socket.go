@@ -0,0 +1,49 @@
+package multiplex
+
+import (
+	"net"
+)
+
+// ----------------------------------------------------------------------
+//
+//   SOCKET OPTIONS
+//
+// ----------------------------------------------------------------------
+// The multiplexer owns the connection, but the socket options are still the
+// caller's to tune. Note that TCP_NODELAY is on by default in Go: frames
+// are written as soon as they are sent, unless write coalescing (see
+// SetWriteCoalesce) batches them, and turning it off adds Nagle's delay on top
+// of the coalescing delay.
+
+// TCPConn returns the TCP connection under the Multiplex, to set socket
+// options on it (keepalive, buffer sizes), and false if the transport is
+// not TCP. Connections that wrap another one and expose it with a NetConn
+// method (i.e. *tls.Conn) are unwrapped. Reading or writing it directly
+// breaks the framing. After ReplaceConn, call it again.
+func (c *Multiplex) TCPConn() (*net.TCPConn, bool) {
+	conn, _ := c.current.Load().(net.Conn)
+	for conn != nil {
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			return tcp, true
+		}
+
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+
+	return nil, false
+}
+
+// SetNoDelay sets TCP_NODELAY on the TCP connection (see TCPConn). It
+// returns INVALID_ARGUMENT if the transport is not TCP.
+func (c *Multiplex) SetNoDelay(noDelay bool) error {
+	tcp, ok := c.TCPConn()
+	if !ok {
+		return INVALID_ARGUMENT
+	}
+
+	return tcp.SetNoDelay(noDelay)
+}
@@ -0,0 +1,138 @@
+package multiplex
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ----------------------------------------------------------------------
+//
+//   STATS
+//
+// ----------------------------------------------------------------------
+// The connection totals are updated atomically on the data path, so that
+// they can be scraped at any rate without contending for the Multiplex
+// lock.
+
+type counters struct {
+	frames_sent     atomic.Uint64
+	bytes_sent      atomic.Uint64
+	frames_received atomic.Uint64
+	bytes_received  atomic.Uint64
+	errors          [len(error_kinds)]atomic.Uint64
+}
+
+// error_kinds are the errors counted by ErrorCounts, by name.
+var error_kinds = [...]struct {
+	err  MultiplexError
+	name string
+}{
+	{CHANNEL_TIMEOUT, "timeout"},
+	{CHANNEL_CLOSED, "closed"},
+	{CHANNEL_EOF, "eof"},
+	{CHANNEL_TRUNCATED, "truncated"},
+	{CHANNEL_IGNORED, "ignored"},
+	{CHANNEL_FRAME_TOO_LARGE, "frame_too_large"},
+	{CHANNEL_DESYNC, "desync"},
+	{CHANNEL_PROTOCOL, "protocol"},
+	{CHANNEL_VERSION, "version"},
+	{CHANNEL_NO_CONTROL, "no_control"},
+	{CHANNEL_SEQUENCE, "sequence"},
+	{CHANNEL_DIRECTION, "direction"},
+	{CHANNEL_WOULDBLOCK, "would_block"},
+	{CHANNEL_QUEUE_FULL, "queue_full"},
+	{CHANNEL_PAUSED, "paused"},
+	{CHANNEL_CANCELLED, "cancelled"},
+	{CHANNEL_HOLD_FULL, "hold_full"},
+	{CHANNEL_REJECTED, "rejected"},
+	{CHANNEL_STARTUP_TIMEOUT, "startup_timeout"},
+	{CHANNEL_BUFFER_LIMIT, "buffer_limit"},
+	{CHANNEL_RESYNC, "resync"},
+}
+
+// Stats are the data frame totals for a connection. Bytes are payload
+// bytes: headers, sequence numbers and control frames are not counted.
+// Received frames are counted even when ignored (e.g. for a disabled
+// channel), and with write coalescing sent frames are counted when queued.
+type Stats struct {
+	FramesSent     uint64
+	BytesSent      uint64
+	FramesReceived uint64
+	BytesReceived  uint64
+}
+
+// TotalStats returns the totals since the Multiplex was created. It
+// doesn't take the lock: each counter is read atomically, but the counters
+// are not a consistent snapshot of each other.
+func (c *Multiplex) TotalStats() Stats {
+	return Stats{
+		FramesSent:     c.totals.frames_sent.Load(),
+		BytesSent:      c.totals.bytes_sent.Load(),
+		FramesReceived: c.totals.frames_received.Load(),
+		BytesReceived:  c.totals.bytes_received.Load(),
+	}
+}
+
+// ChannelStats returns the data frame totals of a channel since it was
+// enabled (zero for a disabled channel). Unlike TotalStats it takes the
+// lock, and frames received while the channel was disabled are not
+// counted.
+func (c *Multiplex) ChannelStats(channelId uint) Stats {
+	if !c.lock_channel(channelId) {
+		return Stats{}
+	}
+	defer c.Unlock()
+
+	return c.channels[channelId].stats
+}
+
+// count_error counts err, if it's one of the error kinds, and returns it.
+// CHANNEL_IGNORED is only counted for frames that are dropped (see
+// count_ignored), not when it just means "try again".
+func (c *Multiplex) count_error(err error) error {
+	if err != nil && err != CHANNEL_IGNORED {
+		c.count_kind(err)
+	}
+
+	return err
+}
+
+// count_ignored counts a received frame that was dropped: for a disabled
+// channel, malformed, or of an unknown control type.
+func (c *Multiplex) count_ignored() {
+	c.count_kind(CHANNEL_IGNORED)
+}
+
+// count_kind counts err by its MultiplexError: a *SequenceError counts as
+// "sequence", and a *CloseError as "eof" (a close by the peer).
+func (c *Multiplex) count_kind(err error) {
+	var kind MultiplexError
+	if _, ok := err.(*CloseError); ok {
+		kind = CHANNEL_EOF
+	} else if !errors.As(err, &kind) {
+		return
+	}
+
+	for i := range error_kinds {
+		if kind == error_kinds[i].err {
+			c.totals.errors[i].Add(1)
+			return
+		}
+	}
+}
+
+// ErrorCounts returns how many times each kind of error occurred since the
+// Multiplex was created, keyed by kind: "timeout", "closed", "ignored" and
+// so on (one per MultiplexError). Errors are counted when they are returned
+// by Select, Receive, ReadFrame, Stream.Read and the Send functions, stop
+// the background reader, or make it drop a frame; "ignored" counts the
+// received frames that were dropped, i.e. because the two ends disagree on
+// the enabled channels. As TotalStats, it doesn't take the lock.
+func (c *Multiplex) ErrorCounts() map[string]uint64 {
+	counts := make(map[string]uint64, len(error_kinds))
+	for i := range error_kinds {
+		counts[error_kinds[i].name] = c.totals.errors[i].Load()
+	}
+
+	return counts
+}
@@ -1,14 +1,21 @@
 package multiplex
 
 import (
+	"bytes"
+	"io"
 	"log"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const readAheadSize = 512 // the read ahead buffer for ReadByte and ReadString
+
 var (
 	NO_DEADLINE   time.Time
-	LOOP_INTERVAL = 1 * time.Second // the timeout/interval for RunLoop select.
+	LOOP_INTERVAL = 1 * time.Second // the default timeout/interval for RunLoop select (see SetLoopInterval).
 )
 
 type StreamError MultiplexError
@@ -17,8 +24,15 @@ func (e StreamError) Error() string {
 	return string(e)
 }
 
+// Temporary is false for the errors that retrying won't fix, so that i.e.
+// http.Server doesn't keep calling Accept.
 func (e StreamError) Temporary() bool {
-	return MultiplexError(e) != CHANNEL_CLOSED
+	switch MultiplexError(e) {
+	case CHANNEL_CLOSED, CHANNEL_PROTOCOL, CHANNEL_DIRECTION:
+		return false
+	}
+
+	return true
 }
 
 func (e StreamError) Timeout() bool {
@@ -29,52 +43,456 @@ func (e StreamError) Timeout() bool {
  * Stream implements the net.Conn interface on top of a multiplexed channel
  */
 type Stream struct {
-	*Multiplex               // the underlying multiplexor
-	ch             uint      // the selected channel
-	read_deadline  time.Time // current read timeout
+	*Multiplex                   // the underlying multiplexor
+	ch             atomic.Uint32 // the selected channel, read without the lock (see SetChannel)
+	read_deadline  time.Time     // current read timeout
+	write_deadline time.Time     // current write timeout
+	messages       bool          // a Read never returns data from more than one frame (see SetMessageMode)
+	leftover       []byte        // data read ahead by ReadByte and ReadString, returned first (a suffix of ahead)
+	ahead          []byte        // read ahead buffer
+	unread         bool          // the last read was a ReadByte, that can be undone (see UnreadByte)
+	auto_enable    atomic.Bool   // re-enable the channel if it was disabled (see SetAutoReEnable)
 }
 
 func NewStream(m *Multiplex, channelId uint) *Stream {
 	if channelId < MAX_CHANNELS {
-		return &Stream{m, channelId, NO_DEADLINE}
+		return new_stream(m, channelId)
 	} else {
 		return nil
 	}
 }
 
+func new_stream(m *Multiplex, channelId uint) *Stream {
+	s := &Stream{Multiplex: m}
+	s.ch.Store(uint32(channelId))
+	return s
+}
+
+// OpenStream returns a stream for the channel, enabling the channel with
+// the given initial buffer size if it's not enabled yet, or applying the
+// size to it if it is (see SetReadBufferInitial). A size <= 0 keeps the
+// default (see SetInitialBufferSize). It returns INVALID_ARGUMENT for an
+// invalid channel, and CHANNEL_CLOSED if the channel couldn't be enabled
+// (see SetMaxConcurrentChannels and SetTotalBufferLimit).
+func (m *Multiplex) OpenStream(channelId uint, initialBufferSize int) (*Stream, error) {
+	if channelId >= m.max_channels {
+		return nil, INVALID_ARGUMENT
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.channels[channelId] == nil {
+		if !m.enable_channel(channelId, initialBufferSize) {
+			return nil, CHANNEL_CLOSED
+		}
+	} else if initialBufferSize > 0 {
+		if err := m.set_initial(channelId, initialBufferSize); err != nil {
+			return nil, err
+		}
+	}
+
+	return new_stream(m, channelId), nil
+}
+
+// SetReadBufferInitial sets the initial size of the stream channel buffer,
+// that is also the smallest it's shrunk to, growing the buffer to it now if
+// it's smaller: for a stream known to carry large frames it saves the
+// reallocations on the way up, and after each burst (see
+// ReallocationRate). It returns CHANNEL_CLOSED if the channel is not
+// enabled, and CHANNEL_BUFFER_LIMIT if the buffer couldn't grow.
+func (s *Stream) SetReadBufferInitial(n int) error {
+	if n <= 0 {
+		return INVALID_ARGUMENT
+	}
+	ch := s.Channel()
+	if !s.lock_channel(ch) {
+		return CHANNEL_CLOSED
+	}
+
+	defer s.Unlock()
+	return s.set_initial(ch, n)
+}
+
+// Grow makes room in the stream channel buffer for n more bytes, so that
+// the next frames up to that size are buffered without reallocating. As
+// for any channel, the buffer is shrunk again once it's mostly empty: use
+// SetReadBufferInitial to keep it large. It returns CHANNEL_CLOSED if the
+// channel is not enabled, and CHANNEL_BUFFER_LIMIT if the buffer couldn't
+// grow.
+func (s *Stream) Grow(n int) error {
+	if n < 0 {
+		return INVALID_ARGUMENT
+	}
+	ch := s.Channel()
+	if !s.lock_channel(ch) {
+		return CHANNEL_CLOSED
+	}
+
+	defer s.Unlock()
+
+	buf := s.channels[ch]
+	if s.direction == SEND_ONLY || len(buf.data)-buf.offset-buf.length >= n {
+		return nil
+	}
+	if !s.reallocate_channel(ch, n) {
+		return CHANNEL_BUFFER_LIMIT
+	}
+
+	return nil
+}
+
+// set_initial sets the initial size of the channel buffer, and grows the
+// buffer to it.
+func (c *Multiplex) set_initial(channelId uint, n int) error {
+	buf := c.channels[channelId]
+	buf.initial = n
+	if c.direction == SEND_ONLY || len(buf.data) >= n {
+		return nil
+	}
+	if !c.reallocate_channel(channelId, n-buf.length) {
+		return CHANNEL_BUFFER_LIMIT
+	}
+
+	return nil
+}
+
+// Multiplexer returns the underlying Multiplex, to drop to the raw API
+// (i.e. Select, ReadFrame or Pending) from a Stream.
+func (s *Stream) Multiplexer() *Multiplex {
+	return s.Multiplex
+}
+
+// Channel returns the channel the stream is bound to.
+func (s *Stream) Channel() uint {
+	return uint(s.ch.Load())
+}
+
+// File is for code that probes a net.Conn for its file descriptor (i.e.
+// with a type assertion to interface{ File() (*os.File, error) }). A stream
+// shares the connection with the other channels, so it doesn't have one:
+// File always returns CHANNEL_NO_FILE. Use Multiplexer and Channel instead.
+func (s *Stream) File() (*os.File, error) {
+	return nil, CHANNEL_NO_FILE
+}
+
+// SetChannel re-binds the stream to a different channel, which must be
+// enabled. The deadlines are kept. It can be called while the stream is in
+// use: a Read or Write already in progress completes on the previous
+// channel, the following ones use the new channel.
+func (s *Stream) SetChannel(channelId uint) error {
+	if channelId >= s.max_channels {
+		return INVALID_ARGUMENT
+	}
+
+	if !s.lock_channel(channelId) {
+		return CHANNEL_CLOSED
+	}
+
+	s.ch.Store(uint32(channelId))
+	s.Unlock()
+	return nil
+}
+
+// Read copies the data buffered for the stream channel into b. If there is
+// none it waits, until the read deadline (forever if not set), for a frame
+// for the channel: it's notified when whoever reads the connection (RunLoop,
+// Serve, the background reader or another Read) buffers one, or reads the
+// connection itself, bounded by the deadline, if nobody is. It returns
+// io.EOF (or the peer's *CloseError) once the peer closed the channel, or
+// the connection, and all the data was read, and CHANNEL_TIMEOUT when the
+// deadline expires. If the channel is non-blocking (see SetNonBlocking) it
+// returns CHANNEL_WOULDBLOCK (or CHANNEL_PAUSED) instead of waiting.
+//
+// As for a net.Conn, the timeout is a net.Error with Timeout() == true and
+// matches os.ErrDeadlineExceeded, and CHANNEL_CLOSED (the stream, or the
+// connection, was closed on this side) matches net.ErrClosed. Read never
+// returns 0 bytes with a nil error, unless b is empty.
+//
+// In message mode (see SetMessageMode) a Read returns data from one frame
+// only.
 func (s *Stream) Read(b []byte) (int, error) {
-	if false {
-		return s.Receive(time.Second, s.ch, b) // time.Second should be a real timeout
-	} else {
-		for {
-			n, err := s.Multiplex.Read(s.ch, b)
-			if err != nil {
-				log.Println("Stream.Read", s.ch, n, err)
-				return 0, err
+	s.unread = false
+
+	if len(s.leftover) > 0 {
+		n := copy(b, s.leftover)
+		s.leftover = s.leftover[n:]
+		return n, nil
+	}
+
+	n, err := s.read_wait(s.Channel(), b, s.read_deadline, s.messages)
+	for err == CHANNEL_CLOSED && s.reenable() {
+		// disabled (before or while waiting)
+		n, err = s.read_wait(s.Channel(), b, s.read_deadline, s.messages)
+	}
+	return n, s.count_error(err)
+}
+
+// SetAutoReEnable makes Read and Write enable the stream channel again
+// (with the default buffer size) if it was disabled on this side, i.e. by
+// another part of the code calling Disable, instead of returning
+// CHANNEL_CLOSED. A Read that finds the channel disabled while waiting
+// enables it again and goes on waiting. The data that was buffered is
+// lost, as are the frames received while the channel was disabled, and the
+// connection must still be open: once it's closed, the stream returns
+// CHANNEL_CLOSED as usual.
+//
+// Channels are not reference counted: a Disable from anyone drops the
+// channel for everyone, and the next Read or Write brings it back for
+// everyone, so a Disable meant to keep the channel closed doesn't stick
+// while the stream is in use. Closing the stream itself (Close,
+// CloseWithError or CloseAfterDrain) turns the option off.
+func (s *Stream) SetAutoReEnable(on bool) {
+	s.auto_enable.Store(on)
+}
+
+// reenable enables the stream channel if it's disabled and the auto
+// re-enable is on, and returns whether it did.
+func (s *Stream) reenable() bool {
+	if !s.auto_enable.Load() {
+		return false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.reenable_locked()
+}
+
+func (s *Stream) reenable_locked() bool {
+	ch := s.Channel()
+	if !s.auto_enable.Load() || s.closed || s.channels[ch] != nil {
+		return false
+	}
+
+	log.Println("Stream", "re-enable channel", ch)
+	return s.enable_channel(ch, 0)
+}
+
+// read_ahead reads the next data from the channel into the read ahead
+// buffer, if there is no leftover data.
+func (s *Stream) read_ahead() error {
+	if len(s.leftover) > 0 {
+		return nil
+	}
+
+	if s.ahead == nil {
+		s.ahead = make([]byte, readAheadSize)
+	}
+
+	n, err := s.Read(s.ahead[:cap(s.ahead)])
+	s.ahead = s.ahead[:n]
+	s.leftover = s.ahead
+	return err
+}
+
+// ReadByte reads and returns the next byte, blocking as Read does. Together
+// with UnreadByte and ReadString it makes the stream usable for simple
+// parsing without a bufio.Reader on top of it. It may read ahead some of
+// the data buffered for the channel (at most one frame in message mode),
+// which is then returned by the following reads on the stream but is not
+// counted by Pending or Length anymore.
+func (s *Stream) ReadByte() (byte, error) {
+	if err := s.read_ahead(); err != nil && len(s.leftover) == 0 {
+		return 0, err
+	}
+
+	c := s.leftover[0]
+	s.leftover = s.leftover[1:]
+	s.unread = true
+	return c, nil
+}
+
+// UnreadByte undoes the last ReadByte, so that the byte is returned again by
+// the next read. It returns INVALID_ARGUMENT if the last read on the stream
+// was not a ReadByte.
+func (s *Stream) UnreadByte() error {
+	if !s.unread {
+		return INVALID_ARGUMENT
+	}
+
+	s.leftover = s.ahead[len(s.ahead)-len(s.leftover)-1:]
+	s.unread = false
+	return nil
+}
+
+// ReadString reads until the first occurrence of delim, and returns the
+// data read, delimiter included. If an error occurs before finding delim
+// it returns the data read so far and the error (often io.EOF).
+func (s *Stream) ReadString(delim byte) (string, error) {
+	var line []byte
+
+	for {
+		err := s.read_ahead()
+		if i := bytes.IndexByte(s.leftover, delim); i >= 0 {
+			line = append(line, s.leftover[:i+1]...)
+			s.leftover = s.leftover[i+1:]
+			break
+		}
+
+		line = append(line, s.leftover...)
+		s.leftover = nil
+		if err != nil {
+			return string(line), err
+		}
+	}
+
+	s.unread = false
+	return string(line), nil
+}
+
+// read_wait is Stream.Read, for any channel (see also channelIO.Read).
+func (c *Multiplex) read_wait(channelId uint, b []byte, deadline time.Time, messages bool) (int, error) {
+	if c.direction == SEND_ONLY {
+		return 0, CHANNEL_DIRECTION
+	}
+
+	if !c.lock_channel(channelId) {
+		return 0, CHANNEL_CLOSED
+	}
+
+	defer c.Unlock()
+
+	for {
+		buf := c.channels[channelId]
+		if buf == nil {
+			return 0, CHANNEL_CLOSED
+		}
+
+		if !buf.paused {
+			dst := b
+			if messages && len(buf.frames) > 0 && buf.frames[0] < len(dst) {
+				// stop at the end of the message
+				dst = dst[:buf.frames[0]]
 			}
 
-			if n == 0 {
-				if !s.read_deadline.IsZero() && time.Now().After(s.read_deadline) {
-					return 0, CHANNEL_TIMEOUT
+			if n, err := c.read_channel(channelId, dst); n > 0 || err != nil || len(b) == 0 {
+				return n, err
+			}
+			if buf.eof {
+				if err := c.channel_eof(channelId); err != CHANNEL_EOF {
+					return 0, err
 				}
+				// as a net.Conn
+				return 0, io.EOF
+			}
+		}
+
+		if buf.nonblocking && !c.closed {
+			return 0, buf.would_block()
+		}
 
-				time.Sleep(time.Duration(1))
-			} else {
-				return n, nil
+		timeout := time.Duration(0)
+		if !deadline.IsZero() {
+			if timeout = time.Until(deadline); timeout <= 0 {
+				return 0, CHANNEL_TIMEOUT
 			}
 		}
 
-		return 0, nil
+		if err := c.receive_next(timeout, channelId); err == CHANNEL_CLOSED {
+			if buf = c.channels[channelId]; buf != nil && buf.length > 0 {
+				// buffered before the connection was gone, read it first
+				continue
+			}
+			if buf != nil && c.peer_closed {
+				// as a net.Conn whose peer closed the connection
+				return 0, io.EOF
+			}
+			return 0, err
+		} else if err != nil && err != CHANNEL_IGNORED {
+			return 0, err
+		}
 	}
 }
 
+// SetMessageMode preserves message boundaries end to end: each Write on
+// one side is returned by exactly one Read on the other side (that must be
+// in message mode too), as long as b is large enough for the message. If
+// it's not, the first Read returns the beginning of the message and the
+// following Reads the rest of it, never data from the next message. The
+// same messages can be read with ReadFrame on the underlying Multiplex.
+//
+// Empty frames are not buffered, so a zero-length Write sends nothing and
+// is never seen as a message by the peer.
+func (s *Stream) SetMessageMode(on bool) {
+	s.messages = on
+}
+
+// Write sends b as a single frame. The stream write deadline is applied to
+// the connection for the duration of the send only, so it doesn't affect
+// writes from other streams sharing the same connection. A Write blocked on
+// the connection doesn't block a concurrent Read (see begin_write).
 func (s *Stream) Write(b []byte) (int, error) {
-	return s.Send(s.ch, b)
+	s.Lock()
+	defer s.Unlock()
+
+	s.reenable_locked()
+	n, err := s.send_channel(s.Channel(), b, s.write_deadline)
+	if is_timeout(err) {
+		return n, StreamError(CHANNEL_TIMEOUT)
+	}
+
+	return n, err
 }
 
+// WriteTo writes the data received on the stream to w, until the peer
+// closes its side of the channel (nil error) or an error occurs.
+func (s *Stream) WriteTo(w io.Writer) (int64, error) {
+	buffer := make([]byte, 32*1024)
+	total := int64(0)
+
+	for {
+		n, err := s.Read(buffer)
+		if n > 0 {
+			written, werr := w.Write(buffer[:n])
+			total += int64(written)
+			if werr != nil {
+				return total, werr
+			}
+		}
+
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
+
+// CloseWrite tells the peer we are done writing (see Multiplex.CloseWrite).
+func (s *Stream) CloseWrite() error {
+	return s.Multiplex.CloseWrite(s.Channel())
+}
+
+// Close closes the stream, sending a normal close to the peer when control
+// frames are enabled, and disables the channel.
 func (s *Stream) Close() error {
-	s.Disable(s.ch)
-	return nil
+	return s.CloseWithError(CLOSE_NORMAL, "")
+}
+
+// CloseAfterDrain closes the stream as Close does, but lets the data
+// already received on it be read first (see CloseChannelAfterDrain).
+func (s *Stream) CloseAfterDrain() error {
+	s.auto_enable.Store(false)
+	err := s.CloseChannelAfterDrain(s.Channel(), CLOSE_NORMAL, "")
+	if err == CHANNEL_CLOSED {
+		// already closed
+		return nil
+	}
+
+	return err
+}
+
+// CloseWithError is like Close, but gives the peer a reason (see CloseError).
+func (s *Stream) CloseWithError(code int, message string) error {
+	s.auto_enable.Store(false)
+	err := s.CloseChannel(s.Channel(), code, message)
+	if err == CHANNEL_CLOSED {
+		// already closed
+		return nil
+	}
+
+	return err
 }
 
 func (s *Stream) LocalAddr() net.Addr {
@@ -97,15 +515,49 @@ func (s *Stream) SetReadDeadline(t time.Time) error {
 }
 
 func (s *Stream) SetWriteDeadline(t time.Time) error {
-        // since we write directly, we can just set the connection write deadline
-	return s.conn.SetWriteDeadline(t)
+	// the connection is shared, so this is only applied while we are writing
+	s.write_deadline = t
+	return nil
+}
+
+// SetLoopInterval sets the Select timeout used by RunLoop, Serve, Pipe and
+// Listener.Accept for this Multiplex (LOOP_INTERVAL if interval <= 0). It
+// bounds how long a loop iteration can wait for data, i.e. how long the
+// Multiplex lock can be held by an idle loop. A closed connection is
+// noticed right away regardless of the interval.
+func (m *Multiplex) SetLoopInterval(interval time.Duration) {
+	if interval < 0 {
+		interval = 0
+	}
+
+	m.loop_interval.Store(int64(interval))
+}
+
+// LoopInterval returns the Select timeout used by RunLoop (see
+// SetLoopInterval).
+func (m *Multiplex) LoopInterval() time.Duration {
+	if interval := time.Duration(m.loop_interval.Load()); interval > 0 {
+		return interval
+	}
+
+	return LOOP_INTERVAL
 }
 
+// RunLoop selects channels (buffering the received data) until the
+// connection is closed. Idle timeouts are expected and just loop.
 func (m *Multiplex) RunLoop() {
+	m.loops.Add(1)
+	defer m.loops.Done()
+
 	for {
-		if selected, err := m.Select(LOOP_INTERVAL); err == CHANNEL_CLOSED {
+		if selected, err := m.Select(m.LoopInterval()); err == CHANNEL_CLOSED {
 			log.Println("RunLoop", "connection closed")
 			break
+		} else if err == CHANNEL_DIRECTION {
+			log.Println("RunLoop", "send only")
+			break
+		} else if err == CHANNEL_TIMEOUT {
+			// idle, nothing to log
 		} else if err != nil {
 			log.Println("RunLoop", err)
 		} else {
@@ -115,3 +567,52 @@ func (m *Multiplex) RunLoop() {
 		time.Sleep(time.Duration(1))
 	}
 }
+
+// Serve runs the select loop (as RunLoop does) and, the first time data is
+// received on a channel, calls handler in a new goroutine with a Stream for
+// that channel: there is one goroutine per active channel, and handler is
+// called exactly once per channel lifetime. When handler returns the stream
+// is closed, which disables the channel. The handlers are loops too: Done
+// waits for them to return, so they must return once the connection is
+// closed (as reading their Stream does).
+//
+// Serve returns nil when the connection is closed, or the error that made
+// the connection unusable.
+func (m *Multiplex) Serve(handler func(s *Stream)) error {
+	var serving [MAX_CHANNELS]bool
+	var lock sync.Mutex
+
+	m.loops.Add(1)
+	defer m.loops.Done()
+
+	for {
+		selected, err := m.Select(m.LoopInterval())
+		if err == CHANNEL_CLOSED {
+			log.Println("Serve", "connection closed")
+			return nil
+		} else if err == CHANNEL_PROTOCOL || err == CHANNEL_DIRECTION {
+			return err
+		} else if err != nil {
+			continue
+		}
+
+		lock.Lock()
+		if !serving[selected] {
+			serving[selected] = true
+
+			// Serve is still running, so Wait can't have returned yet
+			m.loops.Add(1)
+			go func(s *Stream) {
+				defer m.loops.Done()
+
+				handler(s)
+				s.Close()
+
+				lock.Lock()
+				serving[s.Channel()] = false
+				lock.Unlock()
+			}(NewStream(m, selected))
+		}
+		lock.Unlock()
+	}
+}
@@ -0,0 +1,131 @@
+package multiplex
+
+import (
+	"log"
+	"sync"
+)
+
+// ----------------------------------------------------------------------
+//
+//   SUBSCRIPTIONS
+//
+// ----------------------------------------------------------------------
+// A subscription delivers the frames of a channel to a Go channel, so that
+// they can be received in a select{} together with other events. The
+// background reader (see StartReader) buffers the frames as usual, and a
+// goroutine per subscription moves them from the channel buffer to the Go
+// channel.
+//
+// The Go channel holds SUBSCRIBE_QUEUE_SIZE frames. When the consumer is
+// slower than that, the subscription stops taking frames and they wait in
+// the channel buffer: the reader never blocks and no frame is dropped by
+// the subscription, but the buffer grows, bounded only by the channel and
+// connection limits (see SetChannelMaxMessage and SetTotalBufferLimit),
+// that drop and count the frames past them.
+
+var (
+	SUBSCRIBE_QUEUE_SIZE = 64 // frames queued in a subscription Go channel
+)
+
+type subscription struct {
+	channel   uint
+	out       chan []byte
+	cancelled bool          // set by cancel, under the Multiplex lock
+	done      chan struct{} // closed by cancel, to interrupt a blocked send
+	stopped   chan struct{} // closed when the goroutine returns
+	once      sync.Once
+}
+
+// Subscribe returns a Go channel that receives each frame of the given
+// channel, as a copy the consumer owns, and a function that ends the
+// subscription. It enables the channel (with the default buffer size) and
+// starts the background reader if they are not already.
+//
+// The frames are consumed: a subscribed channel must not be read with
+// Receive, Read or a Stream at the same time, and is better left out of a
+// Select loop. The Go channel is closed once the subscription is
+// cancelled, the channel is disabled or closed by the peer, or the
+// connection is gone (after the frames already buffered were delivered).
+// It's closed right away for an invalid channel or a connection that
+// can't be read.
+//
+// The cancel function stops the subscription goroutine, and returns once
+// it's gone: it can be called more than once, and from any goroutine. The
+// frames not received yet are lost. After the Go channel is closed the
+// goroutine is gone too, and cancel is not needed.
+func (c *Multiplex) Subscribe(channelId uint) (<-chan []byte, func()) {
+	s := &subscription{
+		channel: channelId,
+		out:     make(chan []byte, SUBSCRIBE_QUEUE_SIZE),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	cancel := func() {
+		s.once.Do(func() {
+			c.Lock()
+			s.cancelled = true
+			c.cond.Broadcast()
+			c.Unlock()
+
+			close(s.done)
+		})
+
+		<-s.stopped
+	}
+
+	if channelId >= c.max_channels || c.StartReader() != nil {
+		close(s.out)
+		close(s.stopped)
+		return s.out, cancel
+	}
+
+	c.Lock()
+	if c.channels[channelId] == nil {
+		c.enable_channel(channelId, 0)
+	}
+	c.Unlock()
+
+	go c.run_subscription(s)
+	return s.out, cancel
+}
+
+func (c *Multiplex) run_subscription(s *subscription) {
+	defer close(s.stopped)
+	defer close(s.out)
+
+	c.Lock()
+	defer c.Unlock()
+
+	for !s.cancelled {
+		buf := c.channels[s.channel]
+		if buf == nil {
+			log.Println("Subscribe", s.channel, "disabled")
+			return
+		}
+
+		if !buf.paused {
+			if frame := c.next_frame(s.channel); frame != nil {
+				c.Unlock()
+				select {
+				case s.out <- frame:
+				case <-s.done:
+				}
+				c.Lock()
+				continue
+			}
+
+			if buf.eof {
+				c.channel_eof(s.channel)
+				return
+			}
+		}
+
+		if c.closed || !c.reader {
+			// nothing more will be buffered
+			return
+		}
+
+		c.cond.Wait()
+	}
+}
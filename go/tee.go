@@ -0,0 +1,159 @@
+package multiplex
+
+import (
+	"io"
+	"log"
+)
+
+// ----------------------------------------------------------------------
+//
+//   TEE
+//
+// ----------------------------------------------------------------------
+// A tee mirrors the data buffered for a channel to an io.Writer (i.e. an
+// audit log), without consuming it. The writes happen in a goroutine per
+// tee, so a slow writer doesn't hold the Multiplex lock: received frames
+// are copied to a queue of TEE_QUEUE_SIZE frames, and only when the queue
+// is full the receive path blocks until the writer catches up.
+//
+// The send tap does the same for the outgoing side, with the frames as they
+// are written to the connection, headers included.
+//
+// A sink is a tee that takes the data instead of the channel buffer, for
+// channels receiving more than should be kept in memory.
+
+var (
+	TEE_QUEUE_SIZE = 64 // frames queued for each tee writer
+)
+
+type channelTee struct {
+	name    string // for the log
+	channel uint
+	w       io.Writer
+	queue   chan []byte
+}
+
+func (t *channelTee) run() {
+	var err error
+	for data := range t.queue {
+		if err != nil {
+			// keep draining, so that the receive path never blocks on a failed tee
+			continue
+		}
+
+		if _, err = t.w.Write(data); err != nil {
+			log.Println(t.name, t.channel, err)
+		}
+	}
+}
+
+// TeeChannel adds w as a tee for the given channel: every frame buffered
+// for the channel is also written to w, in order. A channel can have
+// multiple tees, and a nil w removes all the tees of the channel (the
+// frames already queued are still written). Tees are kept when the channel
+// is disabled and re-enabled. After a write error the tee discards the
+// following frames.
+func (c *Multiplex) TeeChannel(channelId uint, w io.Writer) error {
+	if channelId >= c.max_channels {
+		return INVALID_ARGUMENT
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if w == nil {
+		for _, t := range c.tees[channelId] {
+			close(t.queue)
+		}
+
+		c.tees[channelId] = nil
+		return nil
+	}
+
+	t := &channelTee{name: "TeeChannel", channel: channelId, w: w, queue: make(chan []byte, TEE_QUEUE_SIZE)}
+	c.tees[channelId] = append(c.tees[channelId], t)
+	go t.run()
+	return nil
+}
+
+func (c *Multiplex) tee_channel(channelId uint, data []byte) {
+	for _, t := range c.tees[channelId] {
+		t.queue <- append([]byte(nil), data...)
+	}
+}
+
+// SetChannelSink makes the frames received for the channel go to w, in
+// order, instead of the channel buffer, so that a large inbound stream is
+// never accumulated in memory: the data already buffered stays there, the
+// following frames are only written to w (and to the tees). They are not
+// seen by Select, Read or Receive, but the channel must stay enabled for
+// them to be received.
+//
+// As for TeeChannel the frames are queued for a goroutine writing to w, and
+// when TEE_QUEUE_SIZE frames are waiting the receive path blocks, holding
+// the Multiplex lock, until w catches up: the connection is not read in the
+// meantime, which pushes back on the peer. So w must not wait on this
+// Multiplex. After a write error the sink discards the following frames. A
+// nil w removes the sink (the frames already queued are still written).
+// Sinks are kept when the channel is disabled and re-enabled.
+func (c *Multiplex) SetChannelSink(channelId uint, w io.Writer) error {
+	if channelId >= c.max_channels {
+		return INVALID_ARGUMENT
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if sink := c.sinks[channelId]; sink != nil {
+		close(sink.queue)
+		c.sinks[channelId] = nil
+	}
+
+	if w != nil {
+		sink := &channelTee{name: "SetChannelSink", channel: channelId, w: w, queue: make(chan []byte, TEE_QUEUE_SIZE)}
+		c.sinks[channelId] = sink
+		go sink.run()
+	}
+
+	return nil
+}
+
+// SetSendTap mirrors every frame written to the connection to w, byte for
+// byte (header, sequence number and payload, control frames included), so
+// that the recording can be replayed with ReadFrom. With a codec the frames
+// are recorded in the built-in format. A frame that was only partially
+// written is recorded as far as it went out. As for TeeChannel the frames
+// are queued for a goroutine writing to w, and a send only blocks when
+// TEE_QUEUE_SIZE frames are waiting. A nil w removes the tap (the frames
+// already queued are still written).
+func (c *Multiplex) SetSendTap(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.send_tap != nil {
+		close(c.send_tap.queue)
+		c.send_tap = nil
+	}
+
+	if w != nil {
+		c.send_tap = &channelTee{name: "SetSendTap", w: w, queue: make(chan []byte, TEE_QUEUE_SIZE)}
+		go c.send_tap.run()
+	}
+}
+
+// tap_sent mirrors the first written bytes of buffers to the send tap.
+func (c *Multiplex) tap_sent(buffers [][]byte, written int) {
+	if c.send_tap == nil || written <= 0 {
+		return
+	}
+
+	data := make([]byte, 0, written)
+	for _, b := range buffers {
+		if len(data)+len(b) > written {
+			b = b[:written-len(data)]
+		}
+		data = append(data, b...)
+	}
+
+	c.send_tap.queue <- data
+}
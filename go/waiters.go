@@ -0,0 +1,89 @@
+package multiplex
+
+import (
+	"sort"
+	"time"
+)
+
+// ----------------------------------------------------------------------
+//
+//   BLOCKED OPERATIONS
+//
+// ----------------------------------------------------------------------
+// Select, Receive (and ReadFrame, Stream.Read) and ReadAny register
+// themselves while they wait for a frame, so that a hang can be diagnosed
+// (and the waiters woken up) at runtime. The registry is only touched under the
+// lock, and only by calls that actually have to wait.
+
+const ANY_CHANNEL = MAX_CHANNELS // the channel of a Select (or ReadAny), that waits for any channel
+
+// BlockedOp describes a goroutine waiting in Select, Receive or ReadAny.
+type BlockedOp struct {
+	Op        string    // "Select", "Receive" (also for ReadFrame and Stream.Read) or "ReadAny"
+	ChannelId uint      // the channel waited for (ANY_CHANNEL for Select and ReadAny)
+	Since     time.Time // when it started waiting
+}
+
+type waiter struct {
+	BlockedOp
+	cancelled bool   // woken up by CancelChannelWaiters
+	frame     []byte // frame handed to ReadAny (see read_unlocked)
+	frame_id  uint   // channel of frame
+}
+
+func (c *Multiplex) add_waiter(op string, channelId uint) *waiter {
+	if channelId >= c.max_channels {
+		channelId = ANY_CHANNEL
+	}
+	if c.waiters == nil {
+		c.waiters = make(map[*waiter]struct{})
+	}
+
+	w := &waiter{BlockedOp: BlockedOp{Op: op, ChannelId: channelId, Since: time.Now()}}
+	c.waiters[w] = struct{}{}
+	return w
+}
+
+func (c *Multiplex) remove_waiter(w *waiter) {
+	delete(c.waiters, w)
+}
+
+// BlockedOps returns a snapshot of the goroutines currently waiting in
+// Select, Receive or ReadAny (including the one blocked reading the
+// connection), oldest first.
+func (c *Multiplex) BlockedOps() []BlockedOp {
+	c.Lock()
+	defer c.Unlock()
+
+	ops := make([]BlockedOp, 0, len(c.waiters))
+	for w := range c.waiters {
+		ops = append(ops, w.BlockedOp)
+	}
+
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Since.Before(ops[j].Since) })
+	return ops
+}
+
+// CancelChannelWaiters wakes up the goroutines waiting for the given
+// channel (ANY_CHANNEL for the ones in Select and ReadAny), that return
+// CHANNEL_CANCELLED, and returns how many there were. Without the
+// background reader, the goroutine that is reading the connection can't be
+// interrupted: it's cancelled when its read returns.
+func (c *Multiplex) CancelChannelWaiters(channelId uint) int {
+	c.Lock()
+	defer c.Unlock()
+
+	cancelled := 0
+	for w := range c.waiters {
+		if w.ChannelId == channelId && !w.cancelled {
+			w.cancelled = true
+			cancelled++
+		}
+	}
+
+	if cancelled > 0 {
+		c.cond.Broadcast()
+	}
+
+	return cancelled
+}